@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 单个分组中为计算百分位保留的数值个数上限，超出后改为蓄水池抽样
+const aggMaxValues = 10000
+
+// 整个聚合任务保留的数值个数达到maxValues后，每个分组仍至少保留的个数
+const aggMinValues = 100
+
+// 分组数超过上限后，新的分组按时间桶合并到该分组中
+const aggOtherKey = "_other"
+
+// AggMetric 聚合指标：Op为count/sum/min/max/avg/percentile，Col为数值列的下标（从0开始）
+type AggMetric struct {
+	Op      string
+	Col     int
+	Percent float64
+	Name    string
+}
+
+// aggState 一个分组中某个指标的计算状态
+type aggState struct {
+	count  int64
+	sum    float64
+	min    float64
+	max    float64
+	values []float64
+}
+
+type aggGroup struct {
+	keys   []string
+	bucket int64
+	count  int64
+	states []aggState
+}
+
+// aggregator 聚合模式下在agent上按列与时间桶分组计算指标，检索任务只返回聚合结果
+type aggregator struct {
+	mu        sync.Mutex
+	groupBy   []int
+	names     []string
+	interval  int64
+	metrics   []AggMetric
+	maxGroups int
+	// 所有分组为计算百分位保留的数值个数上限与当前个数
+	maxValues int
+	values    int
+	groups    map[string]*aggGroup
+	Output    string
+}
+
+// 列名：优先使用logHeader中的名称，否则为colN（N从1开始）
+func colName(col int, logHeader []string) string {
+	if col >= 0 && col < len(logHeader) {
+		return logHeader[col]
+	}
+	return "col" + strconv.Itoa(col+1)
+}
+
+// 把请求中的列引用（从1开始的列号或logHeader中的列名）转换为列下标
+func colIndex(v interface{}, logHeader []string) int {
+	switch val := v.(type) {
+	case float64:
+		return int(val) - 1
+	default:
+		name := fmt.Sprint(val)
+		for i, h := range logHeader {
+			if h == name {
+				return i
+			}
+		}
+		if n, err := strconv.Atoi(strings.TrimPrefix(name, "col")); err == nil {
+			return n - 1
+		}
+	}
+	return -1
+}
+
+// 根据请求中的aggregate参数生成聚合器，参数已由check.FreeSearchCheck校验；
+// maxValues为百分位保留的数值总数上限，0表示只受每个分组的aggMaxValues限制
+func newAggregator(data map[string]interface{}, logHeader []string, maxGroups int, maxValues int) *aggregator {
+	agg := &aggregator{maxGroups: maxGroups, maxValues: maxValues, groups: map[string]*aggGroup{}, Output: "callback"}
+	if v, ok := data["output"]; ok {
+		agg.Output = fmt.Sprint(v)
+	}
+	if v, ok := data["interval"]; ok {
+		agg.interval = int64(v.(float64) * float64(time.Second))
+	}
+	if v, ok := data["groupBy"]; ok {
+		for _, g := range v.([]interface{}) {
+			col := colIndex(g, logHeader)
+			agg.groupBy = append(agg.groupBy, col)
+			agg.names = append(agg.names, colName(col, logHeader))
+		}
+	}
+	metrics, _ := data["metrics"].([]interface{})
+	for _, m := range metrics {
+		mMap := m.(map[string]interface{})
+		metric := AggMetric{Op: fmt.Sprint(mMap["op"]), Col: -1}
+		if c, ok := mMap["col"]; ok {
+			metric.Col = colIndex(c, logHeader)
+		}
+		if p, ok := mMap["percent"]; ok {
+			metric.Percent = p.(float64)
+		}
+		if n, ok := mMap["name"]; ok {
+			metric.Name = fmt.Sprint(n)
+		} else if metric.Op == "count" {
+			metric.Name = "count"
+		} else if metric.Op == "percentile" {
+			metric.Name = "p" + strconv.FormatFloat(metric.Percent, 'f', -1, 64) + "(" + colName(metric.Col, logHeader) + ")"
+		} else {
+			metric.Name = metric.Op + "(" + colName(metric.Col, logHeader) + ")"
+		}
+		agg.metrics = append(agg.metrics, metric)
+	}
+	if len(agg.metrics) == 0 {
+		agg.metrics = append(agg.metrics, AggMetric{Op: "count", Col: -1, Name: "count"})
+	}
+	return agg
+}
+
+// add 把一条符合条件的日志计入所属分组
+func (agg *aggregator) add(strList []string, ts int64) {
+	keys := make([]string, len(agg.groupBy))
+	for i, col := range agg.groupBy {
+		if col >= 0 && col < len(strList) {
+			keys[i] = strList[col]
+		}
+	}
+	var bucket int64
+	if agg.interval > 0 {
+		bucket = ts - ts%agg.interval
+	}
+	key := strings.Join(keys, "\x00") + "\x00" + strconv.FormatInt(bucket, 10)
+
+	agg.mu.Lock()
+	defer agg.mu.Unlock()
+	g, ok := agg.groups[key]
+	if !ok {
+		if agg.maxGroups > 0 && len(agg.groups) >= agg.maxGroups {
+			key = aggOtherKey + "\x00" + strconv.FormatInt(bucket, 10)
+			g, ok = agg.groups[key]
+			keys = nil
+			for range agg.groupBy {
+				keys = append(keys, aggOtherKey)
+			}
+		}
+		if !ok {
+			g = &aggGroup{keys: keys, bucket: bucket, states: make([]aggState, len(agg.metrics))}
+			agg.groups[key] = g
+		}
+	}
+	g.count++
+	for i, m := range agg.metrics {
+		if m.Op == "count" {
+			continue
+		}
+		if m.Col < 0 || m.Col >= len(strList) {
+			continue
+		}
+		v, err := strconv.ParseFloat(strings.TrimSpace(strList[m.Col]), 64)
+		if err != nil {
+			continue
+		}
+		s := &g.states[i]
+		if s.count == 0 || v < s.min {
+			s.min = v
+		}
+		if s.count == 0 || v > s.max {
+			s.max = v
+		}
+		s.count++
+		s.sum += v
+		if m.Op == "percentile" {
+			agg.keepValue(s, v)
+		}
+	}
+}
+
+// 为百分位保留一个数值：总数未超过maxValues时每个分组最多保留aggMaxValues个，
+// 超过后只有不足aggMinValues个的分组继续追加，其余分组在已保留的数值上做蓄水池抽样
+func (agg *aggregator) keepValue(s *aggState, v float64) {
+	n := len(s.values)
+	if n < aggMinValues || (n < aggMaxValues && (agg.maxValues <= 0 || agg.values < agg.maxValues)) {
+		s.values = append(s.values, v)
+		agg.values++
+	} else if r := rand.Int63n(s.count); r < int64(n) {
+		s.values[r] = v
+	}
+}
+
+// 按最近秩法计算百分位
+func percentile(values []float64, percent float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	rank := int(math.Ceil(percent / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	if rank > len(sorted) {
+		rank = len(sorted)
+	}
+	return sorted[rank-1]
+}
+
+// Rows 返回聚合结果，每个分组一行，按时间桶和分组值排序
+func (agg *aggregator) Rows() []map[string]interface{} {
+	agg.mu.Lock()
+	defer agg.mu.Unlock()
+	var groups []*aggGroup
+	for _, g := range agg.groups {
+		groups = append(groups, g)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].bucket != groups[j].bucket {
+			return groups[i].bucket < groups[j].bucket
+		}
+		return strings.Join(groups[i].keys, "\x00") < strings.Join(groups[j].keys, "\x00")
+	})
+	var rows []map[string]interface{}
+	for _, g := range groups {
+		row := map[string]interface{}{}
+		for i, name := range agg.names {
+			row[name] = g.keys[i]
+		}
+		if agg.interval > 0 {
+			row["_time"] = time.Unix(0, g.bucket).Format(time.RFC3339Nano)
+		}
+		for i, m := range agg.metrics {
+			s := g.states[i]
+			if m.Op != "count" && m.Op != "sum" && s.count == 0 {
+				// 分组中没有可解析为数值的值，结果为null，与真实的0区分
+				row[m.Name] = nil
+				continue
+			}
+			switch m.Op {
+			case "count":
+				row[m.Name] = g.count
+			case "sum":
+				row[m.Name] = s.sum
+			case "min":
+				row[m.Name] = s.min
+			case "max":
+				row[m.Name] = s.max
+			case "avg":
+				row[m.Name] = s.sum / float64(s.count)
+			case "percentile":
+				row[m.Name] = percentile(s.values, m.Percent)
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 告警指标：count为符合条件的日志数，ratio为其中又符合alert.match规则的比例，其他值为聚合指标名
+const (
+	AlertMetricCount = "count"
+	AlertMetricRatio = "ratio"
+)
+
+// 告警中返回的聚合结果行数上限
+const alertMaxRows = 20
+
+// alerter 定期检索的阈值告警：在扫描时统计符合条件的日志并保留抽样行，检索结束后与阈值比较
+type alerter struct {
+	mu        sync.Mutex
+	metric    string
+	op        string
+	threshold float64
+	match     []RuleStruct
+	minTotal  int64
+	samples   int
+	count     int64
+	total     int64
+	sample    []string
+	rnd       *rand.Rand
+}
+
+// AlertResult 告警的判断结果，Count/Total为ratio的分子与分母，Rows为超过阈值的聚合结果行
+type AlertResult struct {
+	Metric    string
+	Op        string
+	Threshold float64
+	Value     float64
+	Count     int64
+	Total     int64 `json:",omitempty"`
+	Triggered bool
+	Rows      []map[string]interface{} `json:",omitempty"`
+	Samples   []string                 `json:",omitempty"`
+}
+
+// AlertEvent 告警webhook的内容
+type AlertEvent struct {
+	SavedId     string
+	TaskId      string
+	HostName    string
+	AlertTs     int64
+	WindowStart int64
+	WindowEnd   int64
+	AlertResult
+}
+
+// 根据定期检索的alert参数生成告警，参数已由check.SavedCheck校验
+func newAlerter(data map[string]interface{}) *alerter {
+	a := &alerter{metric: fmt.Sprint(data["metric"]), op: ">=", threshold: data["threshold"].(float64),
+		minTotal: 1, samples: 5, rnd: rand.New(rand.NewSource(time.Now().UnixNano()))}
+	if v, ok := data["op"]; ok {
+		a.op = fmt.Sprint(v)
+	}
+	if v, ok := data["minTotal"]; ok {
+		a.minTotal = int64(v.(float64))
+	}
+	if v, ok := data["samples"]; ok {
+		a.samples = int(v.(float64))
+	}
+	match, _ := data["match"].([]interface{})
+	for _, v := range match {
+		ru := RuleStruct{}
+		arr, _ := json.Marshal(v)
+		if json.Unmarshal(arr, &ru) == nil {
+			a.match = append(a.match, ru)
+		}
+	}
+	return a
+}
+
+// observe 统计一条符合检索条件的日志，strList与line为脱敏前的内容，抽样行脱敏后保存
+func (a *alerter) observe(strList []string, line string, sp *SearchParam) {
+	if a == nil {
+		return
+	}
+	hit := a.metric != AlertMetricRatio || isTrueLog(strList, a.match)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.total++
+	if !hit {
+		return
+	}
+	a.count++
+	if a.samples <= 0 {
+		return
+	}
+	// 蓄水池抽样，保留的行在窗口内均匀分布
+	i := len(a.sample)
+	if i >= a.samples {
+		if i = int(a.rnd.Int63n(a.count)); i >= a.samples {
+			return
+		}
+	}
+	line = sp.Fields.redactLine(line, sp)
+	if ContextMaxBytes > 0 && len(line) > ContextMaxBytes {
+		line = line[:ContextMaxBytes]
+	}
+	if i == len(a.sample) {
+		a.sample = append(a.sample, line)
+	} else {
+		a.sample[i] = line
+	}
+}
+
+func (a *alerter) cross(v float64) bool {
+	switch a.op {
+	case ">":
+		return v > a.threshold
+	case "<":
+		return v < a.threshold
+	case "<=":
+		return v <= a.threshold
+	}
+	return v >= a.threshold
+}
+
+// 聚合结果中的数值
+func rowValue(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+// evaluate 检索结束后判断是否超过阈值，rows为聚合结果
+func (a *alerter) evaluate(rows []map[string]interface{}) *AlertResult {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	ret := &AlertResult{Metric: a.metric, Op: a.op, Threshold: a.threshold, Count: a.count}
+	switch a.metric {
+	case AlertMetricCount:
+		ret.Value = float64(a.count)
+		ret.Triggered = a.cross(ret.Value)
+	case AlertMetricRatio:
+		ret.Total = a.total
+		if a.total > 0 {
+			ret.Value = float64(a.count) / float64(a.total)
+		}
+		ret.Triggered = a.total >= a.minTotal && a.cross(ret.Value)
+	default:
+		// 任意一行聚合结果超过阈值即告警，Value为超过阈值的行中偏离阈值最远的值
+		for _, row := range rows {
+			v, ok := rowValue(row[a.metric])
+			if !ok || !a.cross(v) {
+				continue
+			}
+			further := v > ret.Value
+			if strings.HasPrefix(a.op, "<") {
+				further = v < ret.Value
+			}
+			if !ret.Triggered || further {
+				ret.Value = v
+			}
+			ret.Triggered = true
+			if len(ret.Rows) < alertMaxRows {
+				ret.Rows = append(ret.Rows, row)
+			}
+		}
+	}
+	if ret.Triggered {
+		ret.Samples = append([]string(nil), a.sample...)
+	}
+	return ret
+}
+
+// 告警回调AlertWebhook（未配置时为RetUrl），与检索结果的回调共用HTTP客户端
+func postAlert(event AlertEvent) error {
+	jsonBytes, _ := json.Marshal(event)
+	log.Println(string(jsonBytes))
+	url := AlertWebhook
+	if url == "" {
+		url = RetUrl
+	}
+	resp, err := retClient.Post(url, "application/json;charset=utf-8", strings.NewReader(string(jsonBytes)))
+	if err != nil {
+		return err
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("alert webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -5,14 +5,24 @@ import (
 	"github.com/go-playground/validator/v10"
 	"log"
 	"os"
+	"path/filepath"
+	"reflect"
 	"regexp"
 	"searchlog/handle"
 	"strconv"
 	"strings"
+	"time"
 )
 
 var HostName string
 
+// PrivacyCols 配置文件中排除列与脱敏规则引用的列（不含"*"），键为日志类型，""为对所有日志类型生效的[Privacy]，由main根据配置文件设置。
+// [Privacy]中的列名必须能在请求的logHeader中找到，否则拒绝请求，避免请求省略或改名后规则失效
+var PrivacyCols = map[string][]string{}
+
+// MaxSampleSize 蓄水池抽样size的上限，蓄水池中的日志在任务结束前都保存在内存中，由配置文件maxSampleSize设置
+var MaxSampleSize = 10000
+
 func init() {
 	HostName, _ = os.Hostname()
 }
@@ -34,6 +44,10 @@ func checkIsInt(fl validator.FieldLevel) bool {
 	}
 }
 
+func checkIsNum(fl validator.FieldLevel) bool {
+	return fl.Field().Kind() == reflect.Float64
+}
+
 func checkIsStr(fl validator.FieldLevel) bool {
 	return !checkIsInt(fl)
 }
@@ -118,6 +132,217 @@ func checkSelectRegular(data map[string]interface{}) (string, bool) {
 	return "", true
 }
 
+// 检查列引用：从1开始的列号，或logHeader中的列名，或colN
+func checkColRef(v interface{}, logHeader []string) bool {
+	switch val := v.(type) {
+	case float64:
+		return val == float64(int64(val)) && val > 0 && val < 256
+	case string:
+		if handle.InSlice(logHeader, val) {
+			return true
+		}
+		n, err := strconv.Atoi(strings.TrimPrefix(val, "col"))
+		return strings.HasPrefix(val, "col") && err == nil && n > 0 && n < 256
+	}
+	return false
+}
+
+// 取出请求中的logHeader列名（去掉声明的类型）
+func logHeaderNames(data map[string]interface{}) []string {
+	var names []string
+	logHeader, _ := data["logHeader"].([]interface{})
+	for _, v := range logHeader {
+		name, _ := handle.SplitColType(fmt.Sprint(v))
+		names = append(names, name)
+	}
+	return names
+}
+
+func checkAggregate(data map[string]interface{}, logHeader []string) (string, bool) {
+	if v, ok := data["output"]; ok && v != "callback" && v != "es" {
+		return "Error parameter aggregate.output,info: must be callback or es", false
+	}
+	if v, ok := data["interval"]; ok {
+		if f, ok := v.(float64); !ok || f <= 0 {
+			return "Error parameter aggregate.interval,info: must be a positive number of seconds", false
+		}
+	}
+	if v, ok := data["groupBy"]; ok {
+		groupBy, ok := v.([]interface{})
+		if !ok || len(groupBy) > 10 {
+			return "Error parameter aggregate.groupBy,info: value not a list or more than 10 columns", false
+		}
+		for _, g := range groupBy {
+			if !checkColRef(g, logHeader) {
+				return "Error parameter aggregate.groupBy,info: column must be a column number or logHeader name", false
+			}
+		}
+	}
+	if v, ok := data["metrics"]; ok {
+		metrics, ok := v.([]interface{})
+		if !ok || len(metrics) > 20 {
+			return "Error parameter aggregate.metrics,info: value not a list or more than 20 metrics", false
+		}
+		for _, m := range metrics {
+			mMap, ok := m.(map[string]interface{})
+			if !ok {
+				return "Error parameter aggregate.metrics's list,info: value not a dict", false
+			}
+			op := fmt.Sprint(mMap["op"])
+			if !handle.InSlice([]string{"count", "sum", "min", "max", "avg", "percentile"}, op) {
+				return "Error parameter aggregate.metrics's list,info: op must be count/sum/min/max/avg/percentile", false
+			}
+			if op != "count" && !checkColRef(mMap["col"], logHeader) {
+				return "Error parameter aggregate.metrics's list,info: col must be a column number or logHeader name", false
+			}
+			if op == "percentile" {
+				if p, ok := mMap["percent"].(float64); !ok || p <= 0 || p > 100 {
+					return "Error parameter aggregate.metrics's list,info: percent must between 0 and 100", false
+				}
+			}
+		}
+	}
+	return "", true
+}
+
+func checkSummary(data map[string]interface{}, logHeader []string) (string, bool) {
+	columns, ok := data["columns"].([]interface{})
+	if !ok || len(columns) == 0 || len(columns) > 10 {
+		return "Error parameter summary.columns,info: must be a list of 1-10 columns", false
+	}
+	for _, c := range columns {
+		if !checkColRef(c, logHeader) {
+			return "Error parameter summary.columns,info: column must be a column number or logHeader name", false
+		}
+	}
+	if v, ok := data["topN"]; ok {
+		if f, ok := v.(float64); !ok || f != float64(int64(f)) || f < 0 || f > 1000 {
+			return "Error parameter summary.topN,info: must be an integer between 0 and 1000", false
+		}
+	}
+	if v, ok := data["distinct"]; ok {
+		if _, ok := v.(bool); !ok {
+			return "Error parameter summary.distinct,info: value not a bool", false
+		}
+	}
+	return "", true
+}
+
+func checkSample(data map[string]interface{}) (string, bool) {
+	mode, ok := data["mode"]
+	if !ok {
+		mode = "reservoir"
+	}
+	switch mode {
+	case "reservoir":
+		if f, ok := data["size"].(float64); !ok || f != float64(int64(f)) || f <= 0 || f > float64(MaxSampleSize) {
+			return "Error parameter sample.size,info: must be an integer between 1 and " + strconv.Itoa(MaxSampleSize), false
+		}
+	case "systematic":
+		if f, ok := data["every"].(float64); !ok || f != float64(int64(f)) || f < 1 {
+			return "Error parameter sample.every,info: must be a positive integer", false
+		}
+	default:
+		return "Error parameter sample.mode,info: must be reservoir or systematic", false
+	}
+	return "", true
+}
+
+func checkFields(data map[string]interface{}, logHeader []string) (string, bool) {
+	for _, k := range []string{"include", "exclude"} {
+		v, ok := data[k]
+		if !ok {
+			continue
+		}
+		cols, ok := v.([]interface{})
+		if !ok {
+			return "Error parameter fields." + k + ",info: value not a list", false
+		}
+		for _, c := range cols {
+			if !checkColRef(c, logHeader) {
+				return "Error parameter fields." + k + ",info: column must be a column number or logHeader name", false
+			}
+		}
+	}
+	return "", true
+}
+
+func checkRedact(data map[string]interface{}, logHeader []string) (string, bool) {
+	typ := fmt.Sprint(data["type"])
+	if !handle.InSlice([]string{"mask", "hash", "ipTruncate"}, typ) {
+		return "Error parameter redact's list,info: type must be mask/hash/ipTruncate", false
+	}
+	cols, ok := data["cols"].([]interface{})
+	if !ok || len(cols) == 0 {
+		return "Error parameter redact's list,info: cols must be a non-empty list", false
+	}
+	for _, c := range cols {
+		if c != "*" && !checkColRef(c, logHeader) {
+			return "Error parameter redact's list,info: column must be a column number, logHeader name or *", false
+		}
+	}
+	if typ == "mask" {
+		if _, err := regexp.Compile(fmt.Sprint(data["regex"])); err != nil || data["regex"] == nil {
+			return "Error parameter redact's list,info: mask needs a valid regex", false
+		}
+	}
+	return "", true
+}
+
+// RawCheck 检查按文件偏移读取原始日志的参数，文件必须位于allowPaths中某个目录下，allowPaths为空时不允许读取；
+// 检查通过时p为解析符号链接后的路径，读取时必须使用该路径，避免检查之后符号链接被替换
+func RawCheck(data map[string]interface{}, allowPaths []string, p *string) (string, bool) {
+	rules := map[string]interface{}{
+		"hostName":   "required",
+		"logType":    "required,min=2,max=20,ascii,lowercase,excludesall=#*:;? <>/0x2C_0x7C",
+		"file":       "required,checkIsStr,min=2",
+		"offset":     "checkIsNum,gte=0",
+		"before":     "omitempty,checkIsNum,gte=0,lte=1048576",
+		"after":      "omitempty,checkIsNum,gte=0,lte=1048576",
+		"delimiter":  "omitempty,min=1,max=10",
+		"deAllInOne": "omitempty,checkIsBool",
+		"logHeader":  "omitempty",
+	}
+	validate := validator.New()
+	_ = validate.RegisterValidation("checkIsNum", checkIsNum)
+	_ = validate.RegisterValidation("checkIsStr", checkIsStr)
+	_ = validate.RegisterValidation("checkIsBool", checkIsBool)
+	validateMap := validate.ValidateMap(data, rules)
+	for k, v := range validateMap {
+		msg := fmt.Sprintf("Error parameter %s (%s).", k, fmt.Sprint(v))
+		return msg, false
+	}
+	if fmt.Sprint(data["hostName"]) != HostName {
+		return "Not match hostName!", false
+	}
+	if len(allowPaths) == 0 {
+		return "Raw fetch is disabled, rawAllowPaths is not configured!", false
+	}
+	if msg, ok := checkFilters(data); !ok {
+		return msg, ok
+	}
+	logType := fmt.Sprint(data["logType"])
+	if _, ok := data["delimiter"]; !ok && len(PrivacyCols[""])+len(PrivacyCols[logType]) > 0 {
+		return "Error parameter delimiter,info: required by column rules in [Privacy]", false
+	}
+	file := fmt.Sprint(data["file"])
+	if !filepath.IsAbs(file) {
+		return "Error parameter file,info: must be an absolute path", false
+	}
+	realPath, err := filepath.EvalSymlinks(file)
+	if err != nil {
+		return "Error parameter file,info: file not found", false
+	}
+	for _, dir := range allowPaths {
+		dir = filepath.Clean(strings.TrimSpace(dir))
+		if realPath == dir || strings.HasPrefix(realPath, dir+string(filepath.Separator)) {
+			*p = realPath
+			return "", true
+		}
+	}
+	return "Error parameter file,info: not in allowed paths", false
+}
+
 func ScriptCheck(data map[string]interface{}, ScriptPath string) (string, bool) {
 	hostName, ok := data["hostName"]
 	if !ok {
@@ -150,19 +375,185 @@ func ScriptCheck(data map[string]interface{}, ScriptPath string) (string, bool)
 	return "", true
 }
 
+// 检查检索与实时跟踪共用的过滤、字段与脱敏参数
+func checkFilters(data map[string]interface{}) (string, bool) {
+	header := logHeaderNames(data)
+	for _, c := range PrivacyCols[""] {
+		if _, err := strconv.Atoi(c); err != nil && !checkColRef(c, header) {
+			return "Error parameter logHeader,info: column " + c + " required by [Privacy] is not declared", false
+		}
+	}
+	selectRegular, ok := data["selectRegular"]
+	if ok {
+		selectRegularList, ok := selectRegular.([]interface{})
+		if !ok {
+			return "Error parameter selectRegular,info: value not a list", false
+		}
+		for _, v := range selectRegularList {
+			vMap, ok := v.(map[string]interface{})
+			if !ok {
+				return "Error parameter selectRegular's list,info: value not a dict", false
+			}
+			msg, ok := checkSelectRegular(vMap)
+			if !ok {
+				return msg, ok
+			}
+		}
+	}
+	fields, ok := data["fields"]
+	if ok {
+		fieldsMap, ok := fields.(map[string]interface{})
+		if !ok {
+			return "Error parameter fields,info: value not a dict", false
+		}
+		msg, ok := checkFields(fieldsMap, logHeaderNames(data))
+		if !ok {
+			return msg, ok
+		}
+	}
+	redact, ok := data["redact"]
+	if ok {
+		redactList, ok := redact.([]interface{})
+		if !ok {
+			return "Error parameter redact,info: value not a list", false
+		}
+		for _, v := range redactList {
+			vMap, ok := v.(map[string]interface{})
+			if !ok {
+				return "Error parameter redact's list,info: value not a dict", false
+			}
+			msg, ok := checkRedact(vMap, logHeaderNames(data))
+			if !ok {
+				return msg, ok
+			}
+		}
+	}
+	logHeader, ok := data["logHeader"]
+	if ok {
+		logHeaderList, ok := logHeader.([]interface{})
+		if !ok {
+			return "Error parameter logHeader,info: value not a list", false
+		}
+		for _, v := range logHeaderList {
+			val, _ := handle.SplitColType(fmt.Sprint(v))
+			if len(val) == 0 || len(val) > 20 {
+				return "Error parameter logHeader,info: value length must between 1 and 20", false
+			}
+		}
+	}
+	return "", true
+}
+
 func FreeSearchCheck(data map[string]interface{}, p *[]string) (string, bool) {
+	rules := map[string]interface{}{
+		"hostName":        "required,checkHostName",
+		"startTime":       "required,checkIsNum,gt=0,lt=9000000000000",
+		"endTime":         "required,checkIsNum,gt=0,lt=9000000000000",
+		"taskId":          "required,min=2,max=64,alphanum,lowercase",
+		"logType":         "required,min=2,max=20,ascii,lowercase,excludesall=#*:;? <>/0x2C_0x7C",
+		"logPath":         "required,min=2",
+		"logName":         "required,min=1,max=255",
+		"delimiter":       "required,min=1,max=10",
+		"datePosition":    "required,min=1,max=10,checkDatePosition",
+		"dateFormat":      "required,min=2,max=64",
+		"maxCount":        "omitempty,checkIsInt,gt=0,lte=1000000",
+		"selectRegular":   "omitempty",
+		"deAllInOne":      "omitempty,checkIsBool",
+		"logHeader":       "omitempty",
+		"contextBefore":   "omitempty,checkIsInt,gte=0,lte=50",
+		"contextAfter":    "omitempty,checkIsInt,gte=0,lte=50",
+		"scanWorkers":     "omitempty,checkIsInt,gt=0,lte=256",
+		"priority":        "omitempty,oneof=interactive batch",
+		"timeoutSeconds":  "omitempty,checkIsInt,gt=0",
+		"maxBytesScanned": "omitempty,checkIsInt,gt=0",
+	}
+
+	validate := validator.New()
+	_ = validate.RegisterValidation("checkHostName", checkHostName)
+	_ = validate.RegisterValidation("checkIsInt", checkIsInt)
+	_ = validate.RegisterValidation("checkIsNum", checkIsNum)
+	_ = validate.RegisterValidation("checkDatePosition", checkDatePosition)
+	_ = validate.RegisterValidation("checkIsBool", checkIsBool)
+
+	validateMap := validate.ValidateMap(data, rules)
+	for k, v := range validateMap {
+		msg := fmt.Sprintf("Error parameter %s (%s).", k, fmt.Sprint(v))
+		return msg, false
+	}
+	if _, ok := data["alert"]; ok {
+		return "Error parameter alert,info: only supported by saved searches", false
+	}
+	sT := handle.TimeParamToNano(data["startTime"].(float64), false)
+	eT := handle.TimeParamToNano(data["endTime"].(float64), true)
+	if eT < sT {
+		return "Error parameter endTime,info: endTime>=startTime", false
+	}
+	// 允许的查询时间范围：24小时
+	if eT-sT > int64(time.Hour*24) {
+		return "Error parameter endTime,info: endTime-startTime>1day", false
+	}
+	if _, err := handle.NewDateFormat(fmt.Sprint(data["dateFormat"])); err != nil {
+		return "Error parameter dateFormat,info: " + err.Error(), false
+	}
+	lP := fmt.Sprint(data["logPath"])
+	lN := fmt.Sprint(data["logName"])
+	if !checkLogPathName(lP, lN, p) {
+		return "Error parameter logPath or logName,info: path or file not matched!", false
+	}
+	msg, ok := checkFilters(data)
+	if !ok {
+		return msg, ok
+	}
+	aggregate, ok := data["aggregate"]
+	if ok {
+		aggregateMap, ok := aggregate.(map[string]interface{})
+		if !ok {
+			return "Error parameter aggregate,info: value not a dict", false
+		}
+		msg, ok := checkAggregate(aggregateMap, logHeaderNames(data))
+		if !ok {
+			return msg, ok
+		}
+	}
+	sample, ok := data["sample"]
+	if ok {
+		sampleMap, ok := sample.(map[string]interface{})
+		if !ok {
+			return "Error parameter sample,info: value not a dict", false
+		}
+		msg, ok := checkSample(sampleMap)
+		if !ok {
+			return msg, ok
+		}
+	}
+	summary, ok := data["summary"]
+	if ok {
+		summaryMap, ok := summary.(map[string]interface{})
+		if !ok {
+			return "Error parameter summary,info: value not a dict", false
+		}
+		msg, ok := checkSummary(summaryMap, logHeaderNames(data))
+		if !ok {
+			return msg, ok
+		}
+	}
+	return "", true
+}
+
+// TailCheck 检查实时跟踪任务的参数，不限制时间范围；maxSeconds不能超过maxTailSeconds
+func TailCheck(data map[string]interface{}, maxTailSeconds int, p *[]string) (string, bool) {
 	rules := map[string]interface{}{
 		"hostName":      "required,checkHostName",
-		"startTime":     "required,checkIsInt,gt=0,lt=9000000000",
-		"endTime":       "required,checkIsInt,gt=0",
 		"taskId":        "required,min=2,max=64,alphanum,lowercase",
 		"logType":       "required,min=2,max=20,ascii,lowercase,excludesall=#*:;? <>/0x2C_0x7C",
 		"logPath":       "required,min=2",
 		"logName":       "required,min=1,max=255",
 		"delimiter":     "required,min=1,max=10",
-		"datePosition":  "required,min=1,max=10,checkDatePosition",
-		"dateFormat":    "required,min=2,max=64",
+		"datePosition":  "omitempty,min=1,max=10,checkDatePosition",
+		"dateFormat":    "omitempty,min=2,max=64",
 		"maxCount":      "omitempty,checkIsInt,gt=0,lte=1000000",
+		"maxSeconds":    "omitempty,checkIsInt,gt=0,lte=" + strconv.Itoa(maxTailSeconds),
+		"output":        "omitempty,oneof=stream es",
 		"selectRegular": "omitempty",
 		"deAllInOne":    "omitempty,checkIsBool",
 		"logHeader":     "omitempty",
@@ -179,48 +570,152 @@ func FreeSearchCheck(data map[string]interface{}, p *[]string) (string, bool) {
 		msg := fmt.Sprintf("Error parameter %s (%s).", k, fmt.Sprint(v))
 		return msg, false
 	}
-	sT := int(data["startTime"].(float64))
-	eT := int(data["endTime"].(float64))
-	if eT < sT {
-		return "Error parameter endTime,info: endTime>=startTime", false
+	for _, k := range []string{"aggregate", "summary", "sample", "contextBefore", "contextAfter"} {
+		if _, ok := data[k]; ok {
+			return "Error parameter " + k + ",info: not supported by tail", false
+		}
 	}
-	// 允许的查询时间范围：24小时
-	if eT-sT > 3600*24 {
-		return "Error parameter endTime,info: endTime-startTime>1day", false
+	_, hasPosition := data["datePosition"]
+	if _, ok := data["dateFormat"]; ok != hasPosition {
+		return "Error parameter datePosition or dateFormat,info: must be given together", false
+	} else if ok {
+		if _, err := handle.NewDateFormat(fmt.Sprint(data["dateFormat"])); err != nil {
+			return "Error parameter dateFormat,info: " + err.Error(), false
+		}
 	}
 	lP := fmt.Sprint(data["logPath"])
 	lN := fmt.Sprint(data["logName"])
 	if !checkLogPathName(lP, lN, p) {
 		return "Error parameter logPath or logName,info: path or file not matched!", false
 	}
-	selectRegular, ok := data["selectRegular"]
-	if ok {
-		selectRegularList, ok := selectRegular.([]interface{})
+	return checkFilters(data)
+}
+
+// TailStopCheck 检查停止实时跟踪任务的参数
+func TailStopCheck(data map[string]interface{}) (string, bool) {
+	rules := map[string]interface{}{
+		"hostName": "required,checkHostName",
+		"taskId":   "required,min=2,max=64,alphanum,lowercase",
+	}
+	validate := validator.New()
+	_ = validate.RegisterValidation("checkHostName", checkHostName)
+	validateMap := validate.ValidateMap(data, rules)
+	for k, v := range validateMap {
+		msg := fmt.Sprintf("Error parameter %s (%s).", k, fmt.Sprint(v))
+		return msg, false
+	}
+	return "", true
+}
+
+// SavedCheck 检查定期检索的注册参数：cron与intervalSeconds二选一，search按freeSearch的规则检查（时间范围与taskId由agent生成）
+func SavedCheck(data map[string]interface{}) (string, bool) {
+	rules := map[string]interface{}{
+		"hostName":        "required,checkHostName",
+		"id":              "required,min=2,max=40,alphanum,lowercase",
+		"cron":            "omitempty,min=1,max=100",
+		"intervalSeconds": "omitempty,checkIsInt,gte=60,lte=86400",
+		"search":          "required",
+	}
+	validate := validator.New()
+	_ = validate.RegisterValidation("checkHostName", checkHostName)
+	_ = validate.RegisterValidation("checkIsInt", checkIsInt)
+	validateMap := validate.ValidateMap(data, rules)
+	for k, v := range validateMap {
+		msg := fmt.Sprintf("Error parameter %s (%s).", k, fmt.Sprint(v))
+		return msg, false
+	}
+	_, hasInterval := data["intervalSeconds"]
+	if cron, ok := data["cron"]; ok == hasInterval {
+		return "Error parameter cron or intervalSeconds,info: exactly one of them is required", false
+	} else if ok {
+		if _, err := handle.ParseCron(fmt.Sprint(cron)); err != nil {
+			return "Error parameter cron,info: " + err.Error(), false
+		}
+	}
+	search, ok := data["search"].(map[string]interface{})
+	if !ok {
+		return "Error parameter search,info: value not a dict", false
+	}
+	probe := map[string]interface{}{}
+	for k, v := range search {
+		probe[k] = v
+	}
+	now := time.Now().Unix()
+	probe["hostName"] = HostName
+	probe["taskId"] = fmt.Sprint(data["id"]) + strconv.FormatInt(now, 10)
+	probe["startTime"] = float64(now - 60)
+	probe["endTime"] = float64(now)
+	var fileList []string
+	if msg, ok := FreeSearchCheck(probe, &fileList); !ok {
+		return "Error parameter search,info: " + msg, false
+	}
+	if alert, ok := data["alert"]; ok {
+		alertMap, ok := alert.(map[string]interface{})
 		if !ok {
-			return "Error parameter selectRegular,info: value not a list", false
+			return "Error parameter alert,info: value not a dict", false
 		}
-		for _, v := range selectRegularList {
-			vMap, ok := v.(map[string]interface{})
-			if !ok {
-				return "Error parameter selectRegular's list,info: value not a dict", false
-			}
-			msg, ok := checkSelectRegular(vMap)
-			if !ok {
-				return msg, ok
-			}
+		return checkAlert(alertMap, search)
+	}
+	return "", true
+}
+
+// SavedDeleteCheck 检查删除定期检索的参数
+func SavedDeleteCheck(data map[string]interface{}) (string, bool) {
+	rules := map[string]interface{}{
+		"hostName": "required,checkHostName",
+		"id":       "required,min=2,max=40,alphanum,lowercase",
+	}
+	validate := validator.New()
+	_ = validate.RegisterValidation("checkHostName", checkHostName)
+	validateMap := validate.ValidateMap(data, rules)
+	for k, v := range validateMap {
+		msg := fmt.Sprintf("Error parameter %s (%s).", k, fmt.Sprint(v))
+		return msg, false
+	}
+	return "", true
+}
+
+// 检查定期检索的告警参数：metric为count、ratio（需要match规则）或search.aggregate中的指标名
+func checkAlert(data map[string]interface{}, search map[string]interface{}) (string, bool) {
+	rules := map[string]interface{}{
+		"metric":          "required,min=1,max=64",
+		"op":              "omitempty,oneof=> >= < <=",
+		"threshold":       "required,checkIsNum",
+		"match":           "omitempty",
+		"minTotal":        "omitempty,checkIsInt,gte=1",
+		"samples":         "omitempty,checkIsInt,gte=0,lte=100",
+		"cooldownSeconds": "omitempty,checkIsInt,gte=0",
+	}
+	validate := validator.New()
+	_ = validate.RegisterValidation("checkIsInt", checkIsInt)
+	_ = validate.RegisterValidation("checkIsNum", checkIsNum)
+	validateMap := validate.ValidateMap(data, rules)
+	for k, v := range validateMap {
+		msg := fmt.Sprintf("Error parameter alert.%s (%s).", k, fmt.Sprint(v))
+		return msg, false
+	}
+	metric := fmt.Sprint(data["metric"])
+	if _, ok := search["aggregate"]; !ok && metric != "count" && metric != "ratio" {
+		return "Error parameter alert.metric,info: must be count, ratio or a metric name of search.aggregate", false
+	}
+	match, ok := data["match"]
+	if !ok {
+		if metric == "ratio" {
+			return "Error parameter alert.match,info: required by ratio", false
 		}
+		return "", true
 	}
-	logHeader, ok := data["logHeader"]
-	if ok {
-		logHeaderList, ok := logHeader.([]interface{})
+	matchList, ok := match.([]interface{})
+	if !ok {
+		return "Error parameter alert.match,info: value not a list", false
+	}
+	for _, v := range matchList {
+		vMap, ok := v.(map[string]interface{})
 		if !ok {
-			return "Error parameter logHeader,info: value not a list", false
+			return "Error parameter alert.match's list,info: value not a dict", false
 		}
-		for _, v := range logHeaderList {
-			val := strings.TrimSpace(fmt.Sprint(v))
-			if len(val) == 0 || len(val) > 20 {
-				return "Error parameter logHeader,info: value length must between 1 and 20", false
-			}
+		if msg, ok := checkSelectRegular(vMap); !ok {
+			return msg, ok
 		}
 	}
 	return "", true
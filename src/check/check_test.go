@@ -0,0 +1,97 @@
+package check
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPrivacyColumnsMustResolve(t *testing.T) {
+	defer func(old map[string][]string) { PrivacyCols = old }(PrivacyCols)
+	PrivacyCols = map[string][]string{"": {"client_ip", "cookie", "3"}, "nginx": {"1"}}
+	tests := []struct {
+		name      string
+		logHeader []interface{}
+		ok        bool
+	}{
+		{"no logHeader", nil, false},
+		{"column renamed", []interface{}{"ip", "cookie"}, false},
+		{"one column missing", []interface{}{"client_ip"}, false},
+		{"all declared", []interface{}{"client_ip:ip", "time", "cookie"}, true},
+		{"colN reference", []interface{}{"col1", "client_ip", "cookie"}, true},
+	}
+	for _, tt := range tests {
+		data := map[string]interface{}{}
+		if tt.logHeader != nil {
+			data["logHeader"] = tt.logHeader
+		}
+		if msg, ok := checkFilters(data); ok != tt.ok {
+			t.Errorf("%s: checkFilters = %v (%s), want %v", tt.name, ok, msg, tt.ok)
+		}
+	}
+}
+
+func TestRawCheck(t *testing.T) {
+	defer func(old map[string][]string) { PrivacyCols = old }(PrivacyCols)
+	dir := t.TempDir()
+	file := filepath.Join(dir, "a.log")
+	if err := os.WriteFile(file, []byte("x\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	outside := filepath.Join(t.TempDir(), "b.log")
+	if err := os.WriteFile(outside, []byte("x\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link.log")
+	if err := os.Symlink(outside, link); err != nil {
+		t.Fatal(err)
+	}
+	inner := filepath.Join(dir, "inner.log")
+	if err := os.Symlink(file, inner); err != nil {
+		t.Fatal(err)
+	}
+	realFile, _ := filepath.EvalSymlinks(file)
+	request := func(file string, extra map[string]interface{}) map[string]interface{} {
+		data := map[string]interface{}{"hostName": HostName, "logType": "nginx", "file": file, "offset": float64(0)}
+		for k, v := range extra {
+			data[k] = v
+		}
+		return data
+	}
+	tests := []struct {
+		name       string
+		cols       map[string][]string
+		allowPaths []string
+		data       map[string]interface{}
+		msg        string
+		path       string
+	}{
+		{"disabled without allowPaths", nil, nil, request(file, nil), "disabled", ""},
+		{"allowed", nil, []string{dir}, request(file, nil), "", realFile},
+		{"symlink inside allowPaths resolved", nil, []string{dir}, request(inner, nil), "", realFile},
+		{"offset required", nil, []string{dir}, map[string]interface{}{"hostName": HostName, "logType": "nginx", "file": file}, "offset", ""},
+		{"outside allowPaths", nil, []string{dir}, request(outside, nil), "not in allowed paths", ""},
+		{"symlink escaping allowPaths", nil, []string{dir}, request(link, nil), "not in allowed paths", ""},
+		{"logType required", nil, []string{dir}, map[string]interface{}{"hostName": HostName, "file": file, "offset": float64(0)}, "logType", ""},
+		{"delimiter required by typed rules", map[string][]string{"nginx": {"1"}}, []string{dir}, request(file, nil), "delimiter", ""},
+		{"typed rules of another logType", map[string][]string{"apache": {"1"}}, []string{dir}, request(file, nil), "", ""},
+		{"delimiter given", map[string][]string{"nginx": {"1"}}, []string{dir}, request(file, map[string]interface{}{"delimiter": " "}), "", ""},
+		{"global name missing from logHeader", map[string][]string{"": {"client_ip"}}, []string{dir},
+			request(file, map[string]interface{}{"delimiter": " ", "logHeader": []interface{}{"ip"}}), "client_ip", ""},
+	}
+	for _, tt := range tests {
+		PrivacyCols = tt.cols
+		if PrivacyCols == nil {
+			PrivacyCols = map[string][]string{}
+		}
+		var path string
+		msg, ok := RawCheck(tt.data, tt.allowPaths, &path)
+		if ok != (tt.msg == "") || !strings.Contains(msg, tt.msg) {
+			t.Errorf("%s: RawCheck = %v (%s), want message containing %q", tt.name, ok, msg, tt.msg)
+		}
+		if ok && tt.path != "" && path != tt.path {
+			t.Errorf("%s: resolved path = %s, want %s", tt.name, path, tt.path)
+		}
+	}
+}
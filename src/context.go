@@ -0,0 +1,116 @@
+package main
+
+// LogRecord 一条符合条件的日志及其上下文行
+type LogRecord struct {
+	StrList []string
+	Ts      int64
+	// 所在文件的路径、标识（设备号:inode或路径）与是否为轮转后的压缩文件
+	File    string
+	FileId  string
+	Archive bool
+	// 该行在文件（压缩文件为解压后）中的起始字节偏移与行号
+	Offset int64
+	LineNo int64
+	Before []string
+	After  []string
+	// 富化处理器生成的派生字段，上传时合并到文档中
+	Fields map[string]interface{}
+	// 该行超过maxLineBytes被截断
+	Truncated bool
+	// 已放入抽样蓄水池，任务结束后再上传
+	held bool
+	// 还需要补充的后续上下文行数与字节数
+	needLines int
+	needBytes int
+}
+
+// 估算一条检索结果占用的内存字节数
+func (rec *LogRecord) size() int64 {
+	var n int
+	for _, s := range rec.StrList {
+		n += len(s)
+	}
+	for _, s := range rec.Before {
+		n += len(s)
+	}
+	for _, s := range rec.After {
+		n += len(s)
+	}
+	return int64(n)
+}
+
+// lineContext 类似grep -B/-A，为符合条件的日志收集前后的原始行（不论该行能否解析），按行数与字节数限制
+type lineContext struct {
+	before   int
+	after    int
+	maxBytes int
+	prev     []string
+	pending  []*LogRecord
+}
+
+func newLineContext(before int, after int, maxBytes int) *lineContext {
+	return &lineContext{before: before, after: after, maxBytes: maxBytes}
+}
+
+// 截取不超过字节数限制的前置上下文行，从靠近匹配行的一侧开始计算
+func limitBefore(lines []string, maxBytes int) []string {
+	size := 0
+	for i := len(lines) - 1; i >= 0; i-- {
+		size += len(lines[i])
+		if size > maxBytes {
+			return lines[i+1:]
+		}
+	}
+	return lines
+}
+
+// add 读入一行原始日志，rec为该行符合条件时生成的记录（不符合时为nil）。
+// 该行先作为等待中记录的后续上下文，再为rec补充前置上下文，最后记入前置上下文缓存；返回上下文已收集完成的记录
+func (lc *lineContext) add(line string, rec *LogRecord) []*LogRecord {
+	var done []*LogRecord
+	if len(lc.pending) > 0 {
+		remain := lc.pending[:0]
+		for _, r := range lc.pending {
+			if r.needBytes >= len(line) {
+				r.After = append(r.After, line)
+				r.needLines--
+				r.needBytes -= len(line)
+			} else {
+				r.needLines = 0
+			}
+			if r.needLines <= 0 {
+				done = append(done, r)
+			} else {
+				remain = append(remain, r)
+			}
+		}
+		lc.pending = remain
+	}
+	if rec != nil {
+		if lc.before > 0 {
+			rec.Before = append([]string(nil), limitBefore(lc.prev, lc.maxBytes)...)
+		}
+		if lc.after > 0 {
+			rec.needLines = lc.after
+			rec.needBytes = lc.maxBytes
+			lc.pending = append(lc.pending, rec)
+		} else {
+			done = append(done, rec)
+		}
+	}
+	if lc.before > 0 {
+		lc.prev = append(lc.prev, line)
+		if len(lc.prev) > lc.before {
+			lc.prev = lc.prev[1:]
+		}
+	}
+	return done
+}
+
+// flush 文件读取结束或检索提前结束时，返回全部等待中的记录
+func (lc *lineContext) flush() []*LogRecord {
+	done := lc.pending
+	lc.pending = nil
+	lc.prev = nil
+	return done
+}
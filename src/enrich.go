@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"searchlog/handle"
+	"strconv"
+	"strings"
+)
+
+// EnrichSpec 富化处理器配置：Type为geoip（IP归属地与ASN）、ua（User-Agent解析）、url（拆分路径与参数）、
+// long/double（数值类型转换），Cols为列名或列号
+type EnrichSpec struct {
+	Type string
+	Cols []string
+}
+
+// processor 富化处理器：根据一条日志的列生成派生字段，写入fields，类型转换失败时返回false
+type processor interface {
+	process(strList []string, fields map[string]interface{}) bool
+}
+
+// enrichment 一个检索任务使用的富化处理器，按日志类型配置。geoip与ua只生成归属地、浏览器等派生信息，
+// 在脱敏之前对原始值执行，原始列被排除或脱敏后仍可富化；url与类型转换的结果包含列的原值，在脱敏之后执行
+type enrichment struct {
+	derivers   []processor
+	processors []processor
+	mappings   map[string]string
+}
+
+// 解析配置文件[Enrich]中某种日志类型的处理器，格式：类型|列名,列名;类型|列名
+func parseEnrichSpecs(value string) ([]EnrichSpec, error) {
+	var specs []EnrichSpec
+	for _, item := range strings.Split(value, ";") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "|", 2)
+		spec := EnrichSpec{Type: parts[0]}
+		if len(parts) > 1 {
+			spec.Cols = strings.Split(parts[1], ",")
+		}
+		switch spec.Type {
+		case "geoip":
+			if GeoIPDb == nil && AsnDb == nil {
+				return nil, fmt.Errorf("geoip processor requires geoipDb or asnDb")
+			}
+		case "ua", "url", "long", "double":
+		default:
+			return nil, fmt.Errorf("unknown enrich processor %s", spec.Type)
+		}
+		if len(spec.Cols) == 0 {
+			return nil, fmt.Errorf("enrich processor %s has no columns", spec.Type)
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+// 生成日志类型对应的富化处理器，未配置时返回nil
+func newEnrichment(logType string, logHeader []string) *enrichment {
+	specs := EnrichRules[logType]
+	if len(specs) == 0 {
+		return nil
+	}
+	en := &enrichment{mappings: map[string]string{}}
+	for _, spec := range specs {
+		for _, c := range spec.Cols {
+			c = strings.TrimSpace(c)
+			var ref interface{} = c
+			if n, err := strconv.ParseFloat(c, 64); err == nil {
+				ref = n
+			}
+			col := colIndex(ref, logHeader)
+			if col < 0 {
+				continue
+			}
+			name := colName(col, logHeader)
+			switch spec.Type {
+			case "geoip":
+				en.derivers = append(en.derivers, geoProcessor{col: col, name: name})
+				en.mappings[name+"_location"] = "geo_point"
+				en.mappings[name+"_asn"] = "long"
+			case "ua":
+				en.derivers = append(en.derivers, uaProcessor{col: col, name: name})
+			case "url":
+				en.processors = append(en.processors, urlProcessor{col: col, name: name})
+			case "long", "double":
+				en.processors = append(en.processors, castProcessor{col: col, name: name, typ: spec.Type})
+				en.mappings[name] = spec.Type
+			}
+		}
+	}
+	return en
+}
+
+// derive 对脱敏前的列执行geoip与ua处理器，返回派生字段
+func (en *enrichment) derive(strList []string) map[string]interface{} {
+	if en == nil || len(en.derivers) == 0 {
+		return nil
+	}
+	fields := map[string]interface{}{}
+	for _, p := range en.derivers {
+		p.process(strList, fields)
+	}
+	return fields
+}
+
+// apply 对脱敏后的列执行url与类型转换处理器，结果合并到derive生成的fields中（同名字段覆盖原始列），返回类型转换失败数
+func (en *enrichment) apply(strList []string, fields map[string]interface{}) (map[string]interface{}, int32) {
+	if en == nil {
+		return fields, 0
+	}
+	if fields == nil {
+		fields = map[string]interface{}{}
+	}
+	var failed int32
+	for _, p := range en.processors {
+		if !p.process(strList, fields) {
+			failed++
+		}
+	}
+	return fields, failed
+}
+
+// mapping 派生字段在ES索引中的类型
+func (en *enrichment) mapping() map[string]string {
+	if en == nil {
+		return nil
+	}
+	return en.mappings
+}
+
+// 取列值，列不存在或为空（已被排除）时返回false
+func colValue(strList []string, col int) (string, bool) {
+	if col >= len(strList) {
+		return "", false
+	}
+	v := strings.TrimSpace(strList[col])
+	return v, v != "" && v != "-"
+}
+
+// geoProcessor 从本地mmdb文件查询IP的国家、城市、经纬度与ASN，生成<列名>_country等字段
+type geoProcessor struct {
+	col  int
+	name string
+}
+
+// 按路径取mmdb记录中的值
+func mmdbPath(m map[string]interface{}, path ...string) interface{} {
+	var v interface{} = m
+	for _, p := range path {
+		vm, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = vm[p]
+	}
+	return v
+}
+
+func (p geoProcessor) process(strList []string, fields map[string]interface{}) bool {
+	v, ok := colValue(strList, p.col)
+	if !ok {
+		return true
+	}
+	ip := net.ParseIP(v)
+	if ip == nil {
+		return true
+	}
+	if GeoIPDb != nil {
+		if rec, err := GeoIPDb.Lookup(ip); err == nil && rec != nil {
+			if s, ok := mmdbPath(rec, "country", "iso_code").(string); ok {
+				fields[p.name+"_country"] = s
+			}
+			if s, ok := mmdbPath(rec, "city", "names", "en").(string); ok {
+				fields[p.name+"_city"] = s
+			}
+			lat, ok1 := mmdbPath(rec, "location", "latitude").(float64)
+			lon, ok2 := mmdbPath(rec, "location", "longitude").(float64)
+			if ok1 && ok2 {
+				fields[p.name+"_location"] = strconv.FormatFloat(lat, 'f', -1, 64) + "," + strconv.FormatFloat(lon, 'f', -1, 64)
+			}
+		}
+	}
+	if AsnDb != nil {
+		if rec, err := AsnDb.Lookup(ip); err == nil && rec != nil {
+			if n := mmdbPath(rec, "autonomous_system_number"); n != nil {
+				fields[p.name+"_asn"] = n
+			}
+			if s, ok := mmdbPath(rec, "autonomous_system_organization").(string); ok {
+				fields[p.name+"_org"] = s
+			}
+		}
+	}
+	return true
+}
+
+// uaProcessor 解析User-Agent，生成<列名>_browser、<列名>_os、<列名>_device字段
+type uaProcessor struct {
+	col  int
+	name string
+}
+
+func (p uaProcessor) process(strList []string, fields map[string]interface{}) bool {
+	v, ok := colValue(strList, p.col)
+	if !ok {
+		return true
+	}
+	fields[p.name+"_browser"], fields[p.name+"_os"], fields[p.name+"_device"] = handle.ParseUserAgent(v)
+	return true
+}
+
+// urlProcessor 拆分URL或nginx的request列（GET /path?a=1 HTTP/1.1），生成<列名>_path、<列名>_query、<列名>_host字段
+type urlProcessor struct {
+	col  int
+	name string
+}
+
+func (p urlProcessor) process(strList []string, fields map[string]interface{}) bool {
+	v, ok := colValue(strList, p.col)
+	if !ok {
+		return true
+	}
+	if parts := strings.Fields(v); len(parts) >= 2 {
+		v = parts[1]
+	}
+	u, err := url.Parse(v)
+	if err != nil {
+		return true
+	}
+	fields[p.name+"_path"] = u.Path
+	if u.RawQuery != "" {
+		fields[p.name+"_query"] = u.RawQuery
+	}
+	if u.Host != "" {
+		fields[p.name+"_host"] = u.Hostname()
+	}
+	return true
+}
+
+// castProcessor 把数值列转换为long或double类型，转换失败时原值保存在<列名>_raw中
+type castProcessor struct {
+	col  int
+	name string
+	typ  string
+}
+
+func (p castProcessor) process(strList []string, fields map[string]interface{}) bool {
+	v, _ := colValue(strList, p.col)
+	n, ok := handle.CoerceValue(p.typ, v, handle.DateFormat{})
+	fields[p.name] = n
+	if !ok {
+		fields[p.name+"_raw"] = v
+	}
+	return ok
+}
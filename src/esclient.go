@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ES服务端类型
+const (
+	FlavorElasticsearch = "elasticsearch"
+	FlavorOpenSearch    = "opensearch"
+)
+
+// esConn 直接使用HTTP访问ES的客户端，只使用不带mapping type的API，
+// 兼容Elasticsearch 7.x/8.x与OpenSearch 1.x/2.x。配置多个节点时轮询发送请求，
+// 不可用的节点暂停使用，由健康检查恢复
+type esConn struct {
+	endpoints []*esEndpoint
+	next      uint32
+	auth      string
+	client    *http.Client
+	// 429/5xx及网络错误的最大重试次数与首次重试的等待时间（之后每次翻倍）
+	maxRetries int
+	backoff    time.Duration
+	// 连接时探测到的服务端类型与版本
+	Flavor string
+	Major  int
+	Minor  int
+	Number string
+}
+
+// esEndpoint 一个ES节点
+type esEndpoint struct {
+	host string
+	dead int32
+}
+
+// esError ES返回的错误
+type esError struct {
+	Status int
+	Type   string
+	Reason string
+}
+
+func (e *esError) Error() string {
+	return fmt.Sprintf("elasticsearch: status %d, %s: %s", e.Status, e.Type, e.Reason)
+}
+
+// 可以重试（换一个节点或等待后重试）的错误：网络错误、429与5xx
+func retryable(err error) bool {
+	e, ok := err.(*esError)
+	return !ok || e.Status == http.StatusTooManyRequests || e.Status >= 500
+}
+
+// ES认证：apiKey优先，其次为bearerToken，最后为用户名密码
+func esAuthHeader(apiKey string, bearerToken string, user string, pass string) string {
+	switch {
+	case apiKey != "":
+		// 支持"id:api_key"形式或已经base64编码的形式
+		if strings.Contains(apiKey, ":") {
+			apiKey = base64.StdEncoding.EncodeToString([]byte(apiKey))
+		}
+		return "ApiKey " + apiKey
+	case bearerToken != "":
+		return "Bearer " + bearerToken
+	case user != "":
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pass))
+	}
+	return ""
+}
+
+// hosts为逗号分隔的多个ES地址，tlsConf为nil时使用默认的TLS配置
+func newEsConn(hosts string, auth string, timeout time.Duration, tlsConf *tls.Config, maxRetries int, backoff time.Duration) *esConn {
+	c := &esConn{
+		auth:       auth,
+		client:     newHttpClient(timeout, tlsConf),
+		maxRetries: maxRetries,
+		backoff:    backoff,
+	}
+	for _, h := range strings.Split(hosts, ",") {
+		if h = strings.TrimRight(strings.TrimSpace(h), "/"); h != "" {
+			c.endpoints = append(c.endpoints, &esEndpoint{host: h})
+		}
+	}
+	return c
+}
+
+// 生成HTTP客户端，ES连接与RetUrl回调共用
+func newHttpClient(timeout time.Duration, tlsConf *tls.Config) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if tlsConf != nil {
+		transport.TLSClientConfig = tlsConf
+	}
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+// pick 轮询选择一个可用节点，全部不可用时仍按顺序选择
+func (c *esConn) pick() *esEndpoint {
+	n := uint32(len(c.endpoints))
+	start := atomic.AddUint32(&c.next, 1)
+	for i := uint32(0); i < n; i++ {
+		ep := c.endpoints[(start+i)%n]
+		if atomic.LoadInt32(&ep.dead) == 0 {
+			return ep
+		}
+	}
+	return c.endpoints[start%n]
+}
+
+// Do 发送请求，body为nil、[]byte或可JSON序列化的值；状态码不是2xx时返回*esError。
+// 可重试的错误按退避时间（或响应中的Retry-After）等待后换节点重试，failed不为nil时每次失败都以节点地址回调
+func (c *esConn) Do(method string, path string, params url.Values, body interface{}, failed func(host string)) ([]byte, error) {
+	var payload []byte
+	switch b := body.(type) {
+	case nil:
+	case []byte:
+		payload = b
+	default:
+		marshal, err := json.Marshal(b)
+		if err != nil {
+			return nil, err
+		}
+		payload = marshal
+	}
+	backoff := c.backoff
+	for attempt := 0; ; attempt++ {
+		ep := c.pick()
+		respBody, retryAfter, err := c.send(ep, method, path, params, payload)
+		if err == nil {
+			return respBody, nil
+		}
+		if failed != nil {
+			failed(ep.host)
+		}
+		if !retryable(err) {
+			return nil, err
+		}
+		if e, ok := err.(*esError); !ok || e.Status != http.StatusTooManyRequests {
+			// 网络错误与5xx的节点暂停使用，429只表示节点繁忙
+			atomic.StoreInt32(&ep.dead, 1)
+		}
+		if attempt >= c.maxRetries {
+			return nil, err
+		}
+		wait := backoff
+		if retryAfter > wait {
+			wait = retryAfter
+		}
+		time.Sleep(wait)
+		if backoff *= 2; backoff > maxEsBackoff {
+			backoff = maxEsBackoff
+		}
+	}
+}
+
+// 重试的最长等待时间
+const maxEsBackoff = 30 * time.Second
+
+// 向一个节点发送一次请求，返回响应内容与Retry-After
+func (c *esConn) send(ep *esEndpoint, method string, path string, params url.Values, payload []byte) ([]byte, time.Duration, error) {
+	var reader io.Reader
+	if payload != nil {
+		reader = bytes.NewReader(payload)
+	}
+	u := ep.host + path
+	if len(params) > 0 {
+		u += "?" + params.Encode()
+	}
+	req, err := http.NewRequest(method, u, reader)
+	if err != nil {
+		return nil, 0, err
+	}
+	if reader != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.auth != "" {
+		req.Header.Set("Authorization", c.auth)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(resp.Body)
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		e := &esError{Status: resp.StatusCode}
+		var errBody struct {
+			Error json.RawMessage `json:"error"`
+		}
+		var details struct {
+			Type   string `json:"type"`
+			Reason string `json:"reason"`
+		}
+		if json.Unmarshal(respBody, &errBody) == nil && json.Unmarshal(errBody.Error, &details) == nil {
+			e.Type, e.Reason = details.Type, details.Reason
+		} else {
+			e.Reason = strings.TrimSpace(string(respBody))
+		}
+		var retryAfter time.Duration
+		if sec, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && sec > 0 {
+			retryAfter = time.Duration(sec) * time.Second
+			if retryAfter > maxEsBackoff {
+				retryAfter = maxEsBackoff
+			}
+		}
+		return nil, retryAfter, e
+	}
+	return respBody, 0, nil
+}
+
+// healthCheck 定期检查不可用的节点，恢复后重新参与轮询
+func (c *esConn) healthCheck(interval time.Duration) {
+	for range time.Tick(interval) {
+		for _, ep := range c.endpoints {
+			if atomic.LoadInt32(&ep.dead) == 0 {
+				continue
+			}
+			if _, _, err := c.send(ep, http.MethodGet, "/", nil, nil); err == nil {
+				atomic.StoreInt32(&ep.dead, 0)
+				log.Printf("ES节点%s已恢复", ep.host)
+			}
+		}
+	}
+}
+
+// Ping 依次尝试各节点，探测服务端类型与版本，不可用的节点标记为暂停使用；
+// 低于7.0的Elasticsearch不支持不带mapping type的API，返回错误
+func (c *esConn) Ping() error {
+	var respBody []byte
+	var err error
+	for _, ep := range c.endpoints {
+		if respBody, _, err = c.send(ep, http.MethodGet, "/", nil, nil); err == nil {
+			break
+		}
+		log.Printf("ES节点%s不可用：%s", ep.host, err)
+		atomic.StoreInt32(&ep.dead, 1)
+	}
+	if err != nil {
+		return err
+	}
+	if respBody == nil {
+		return fmt.Errorf("no elasticsearch host configured")
+	}
+	var info struct {
+		Version struct {
+			Number       string `json:"number"`
+			Distribution string `json:"distribution"`
+		} `json:"version"`
+	}
+	if err = json.Unmarshal(respBody, &info); err != nil {
+		return err
+	}
+	c.Number = info.Version.Number
+	c.Flavor = FlavorElasticsearch
+	if info.Version.Distribution == FlavorOpenSearch {
+		c.Flavor = FlavorOpenSearch
+	}
+	parts := strings.Split(c.Number, ".")
+	c.Major, _ = strconv.Atoi(parts[0])
+	if len(parts) > 1 {
+		c.Minor, _ = strconv.Atoi(parts[1])
+	}
+	if c.Flavor == FlavorElasticsearch && c.Major < 7 {
+		return fmt.Errorf("unsupported elasticsearch version %s, 7.x or later is required", c.Number)
+	}
+	return nil
+}
+
+// 是否支持可组合索引模板（_index_template，Elasticsearch 7.8+与OpenSearch 1.0+）
+func (c *esConn) composableTemplates() bool {
+	return c.Flavor == FlavorOpenSearch || c.Major > 7 || c.Minor >= 8
+}
+
+// Index 按文档ID写入一条文档（id为空时由ES生成），已存在时覆盖；
+// create为true时以op_type=create写入（数据流要求），文档已存在视为成功。failed见Do
+func (c *esConn) Index(index string, id string, doc interface{}, create bool, failed func(host string)) error {
+	params := url.Values{}
+	if create {
+		params.Set("op_type", "create")
+	}
+	method, path := http.MethodPost, "/"+url.PathEscape(index)+"/_doc"
+	if id != "" {
+		method, path = http.MethodPut, path+"/"+url.PathEscape(id)
+	}
+	_, err := c.Do(method, path, params, doc, failed)
+	if e, ok := err.(*esError); ok && create && e.Status == http.StatusConflict {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 写入ES的方式：index按namePattern写入普通索引（可按日期命名），datastream写入数据流，由ILM滚动
+const (
+	IndexModeIndex      = "index"
+	IndexModeDataStream = "datastream"
+)
+
+// indexManager 管理索引模板、ILM策略与索引的创建。模板与策略在启动时安装一次，
+// 所有agent共用同一份映射，只按logHeader声明的类型为新索引追加字段映射
+type indexManager struct {
+	mu        sync.Mutex
+	installed bool
+	ensured   map[string]bool
+}
+
+var Indices = &indexManager{ensured: map[string]bool{}}
+
+// 按namePattern生成索引（或数据流）名称，{logType}替换为日志类型，{date}按dateLayout替换为当前日期
+func indexName(logType string, now time.Time) string {
+	name := strings.Replace(IndexPattern, "{logType}", logType, -1)
+	return strings.Replace(name, "{date}", now.Format(IndexDateLayout), -1)
+}
+
+// 模板匹配的索引：namePattern中第一个占位符之前的部分加*
+func indexTemplatePattern() string {
+	prefix := IndexPattern
+	if i := strings.Index(prefix, "{"); i >= 0 {
+		prefix = prefix[:i]
+	}
+	return prefix + "*"
+}
+
+// 所有检索结果索引共用的映射：不确定的字段通过动态模板都定义为keyword，防止日期型的字段被ES自动定义为date类型
+func baseMappings() map[string]interface{} {
+	keyword := map[string]string{"type": "keyword"}
+	properties := map[string]interface{}{
+		"_time":     map[string]string{"type": "date_nanos"},
+		"_hostname": keyword,
+		"0,taskId":  keyword,
+		"*":         keyword,
+		// 日志所在的文件与位置
+		"_file":           keyword,
+		"_offset":         map[string]string{"type": "long"},
+		"_line":           map[string]string{"type": "long"},
+		"_rotatedArchive": map[string]string{"type": "boolean"},
+	}
+	if IndexMode == IndexModeDataStream {
+		properties["@timestamp"] = map[string]string{"type": "date_nanos"}
+	}
+	return map[string]interface{}{
+		"dynamic_templates": []interface{}{
+			map[string]interface{}{"string_fields": map[string]interface{}{
+				"match": "*", "match_mapping_type": "string", "mapping": keyword}},
+			map[string]interface{}{"date_fields": map[string]interface{}{
+				"match": "*", "match_mapping_type": "date", "mapping": keyword}},
+		},
+		"properties": properties,
+	}
+}
+
+func indexSettings() map[string]interface{} {
+	settings := map[string]interface{}{"max_result_window": strconv.Itoa(MaxResultWindow)}
+	// OpenSearch没有ILM，由ISM策略中的ism_template关联索引
+	if IlmPolicy != "" && esClient.Flavor != FlavorOpenSearch {
+		settings["lifecycle"] = map[string]string{"name": IlmPolicy}
+	}
+	return map[string]interface{}{"index": settings}
+}
+
+// ILM策略：数据流模式按大小与时间滚动，retentionDays大于0时到期删除
+func ilmPolicyBody() map[string]interface{} {
+	hot := map[string]interface{}{}
+	if IndexMode == IndexModeDataStream {
+		rollover := map[string]string{}
+		if RolloverMaxSize != "" {
+			rollover["max_size"] = RolloverMaxSize
+		}
+		if RolloverMaxAge != "" {
+			rollover["max_age"] = RolloverMaxAge
+		}
+		if len(rollover) > 0 {
+			hot["rollover"] = rollover
+		}
+	}
+	phases := map[string]interface{}{"hot": map[string]interface{}{"actions": hot}}
+	if IndexRetentionDays > 0 {
+		phases["delete"] = map[string]interface{}{
+			"min_age": strconv.Itoa(IndexRetentionDays) + "d",
+			"actions": map[string]interface{}{"delete": map[string]interface{}{}},
+		}
+	}
+	return map[string]interface{}{"policy": map[string]interface{}{"phases": phases}}
+}
+
+// OpenSearch的ISM策略，与ilmPolicyBody含义相同，通过ism_template自动关联模板匹配的索引
+func ismPolicyBody() map[string]interface{} {
+	var hotActions []interface{}
+	if IndexMode == IndexModeDataStream {
+		rollover := map[string]string{}
+		if RolloverMaxSize != "" {
+			rollover["min_size"] = RolloverMaxSize
+		}
+		if RolloverMaxAge != "" {
+			rollover["min_index_age"] = RolloverMaxAge
+		}
+		if len(rollover) > 0 {
+			hotActions = append(hotActions, map[string]interface{}{"rollover": rollover})
+		}
+	}
+	hot := map[string]interface{}{"name": "hot", "actions": hotActions, "transitions": []interface{}{}}
+	states := []interface{}{hot}
+	if IndexRetentionDays > 0 {
+		hot["transitions"] = []interface{}{map[string]interface{}{
+			"state_name": "delete",
+			"conditions": map[string]string{"min_index_age": strconv.Itoa(IndexRetentionDays) + "d"},
+		}}
+		states = append(states, map[string]interface{}{
+			"name":        "delete",
+			"actions":     []interface{}{map[string]interface{}{"delete": map[string]interface{}{}}},
+			"transitions": []interface{}{},
+		})
+	}
+	return map[string]interface{}{"policy": map[string]interface{}{
+		"description":   "searchlog agent",
+		"default_state": "hot",
+		"states":        states,
+		"ism_template": []interface{}{map[string]interface{}{
+			"index_patterns": []string{indexTemplatePattern()},
+			"priority":       100,
+		}},
+	}}
+}
+
+func esRequest(method string, path string, body interface{}) error {
+	_, err := esClient.Do(method, path, nil, body, nil)
+	return err
+}
+
+// 索引或数据流已被其他agent创建
+func isAlreadyExists(err error) bool {
+	e, ok := err.(*esError)
+	return ok && e.Type == "resource_already_exists_exception"
+}
+
+// 安装生命周期策略：Elasticsearch使用ILM，OpenSearch使用ISM（策略已存在时返回409，不覆盖）
+func installPolicy() error {
+	if esClient.Flavor == FlavorOpenSearch {
+		err := esRequest(http.MethodPut, "/_plugins/_ism/policies/"+IlmPolicy, ismPolicyBody())
+		if e, ok := err.(*esError); ok && e.Status == http.StatusConflict {
+			return nil
+		}
+		return err
+	}
+	return esRequest(http.MethodPut, "/_ilm/policy/"+IlmPolicy, ilmPolicyBody())
+}
+
+// install 安装ILM策略与可组合索引模板（PUT相同内容是幂等的），未配置模板名时不安装
+func (im *indexManager) install() error {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	if im.installed || IndexTemplate == "" {
+		return nil
+	}
+	if IlmPolicy != "" {
+		if err := installPolicy(); err != nil {
+			return err
+		}
+	}
+	template := map[string]interface{}{
+		"settings": indexSettings(),
+		"mappings": baseMappings(),
+	}
+	// 模板中不能同时有别名与data_stream，数据流的别名在创建数据流后添加
+	if IndexAlias != "" && IndexMode != IndexModeDataStream {
+		template["aliases"] = map[string]interface{}{IndexAlias: map[string]interface{}{}}
+	}
+	body := map[string]interface{}{
+		"index_patterns": []string{indexTemplatePattern()},
+		"priority":       100,
+		"template":       template,
+	}
+	if IndexMode == IndexModeDataStream {
+		body["data_stream"] = map[string]interface{}{}
+	}
+	path := "/_index_template/" + IndexTemplate
+	if !esClient.composableTemplates() {
+		// Elasticsearch 7.8以前只支持旧版索引模板
+		body = map[string]interface{}{
+			"index_patterns": body["index_patterns"],
+			"order":          100,
+			"settings":       template["settings"],
+			"mappings":       template["mappings"],
+		}
+		if aliases, ok := template["aliases"]; ok {
+			body["aliases"] = aliases
+		}
+		path = "/_template/" + IndexTemplate
+	}
+	if err := esRequest(http.MethodPut, path, body); err != nil {
+		return err
+	}
+	im.installed = true
+	return nil
+}
+
+// ensure 确保索引或数据流存在，并追加声明了类型的字段映射。每个索引在本进程中只处理一次，
+// 多个agent同时创建时，已存在的错误被忽略
+func (im *indexManager) ensure(name string, properties map[string]map[string]string) {
+	if err := im.install(); err != nil {
+		log.Println("索引模板安装失败：", err)
+	}
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	if im.ensured[name] {
+		return
+	}
+	var err error
+	if IndexMode == IndexModeDataStream {
+		err = esRequest(http.MethodPut, "/_data_stream/"+name, nil)
+	} else {
+		body := map[string]interface{}{}
+		if IndexTemplate == "" {
+			// 未使用模板时由agent在创建索引时带上设置与映射
+			body["settings"] = indexSettings()
+			body["mappings"] = baseMappings()
+		}
+		err = esRequest(http.MethodPut, "/"+name, body)
+	}
+	if err != nil && !isAlreadyExists(err) {
+		log.Println(err)
+		return
+	}
+	if IndexMode == IndexModeDataStream && IndexAlias != "" {
+		// 数据流别名需要Elasticsearch 7.14以上，添加失败不影响写入
+		action := map[string]interface{}{"add": map[string]interface{}{"index": name, "alias": IndexAlias}}
+		if err = esRequest(http.MethodPost, "/_aliases", map[string]interface{}{"actions": []interface{}{action}}); err != nil {
+			log.Println(err)
+		}
+	}
+	if len(properties) > 0 {
+		err = esRequest(http.MethodPut, "/"+name+"/_mapping", map[string]interface{}{"properties": properties})
+		if err != nil {
+			// 字段类型与已有映射冲突时该字段保持原类型，不影响写入
+			log.Println(err)
+		}
+	}
+	im.ensured[name] = true
+}
+
+// docId 由主机名、文件标识、行偏移与任务ID等生成确定的文档ID，
+// 重试、spool重放或重新下发相同的任务时覆盖已有文档，不会重复写入
+func docId(parts ...string) string {
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(sum[:16])
+}
+
+// indexDoc 按文档ID写入一条文档；数据流模式下补充@timestamp并以create方式写入，失败按节点计入st。
+// spool中有待重放的记录时直接写入spool；ES不可用（网络错误、429、5xx）时写入spool，等待恢复后重放
+func indexDoc(sp *SearchParam, id string, doc map[string]interface{}, st *TaskStats) error {
+	create := IndexMode == IndexModeDataStream
+	if create {
+		if ts, ok := doc["_time"]; ok {
+			doc["@timestamp"] = ts
+		} else {
+			doc["@timestamp"] = time.Now().Format(time.RFC3339Nano)
+		}
+	}
+	if Spool.active() && Spool.add(sp.TaskId, sp.EsIndex, id, create, doc) {
+		atomic.AddInt32(&st.SpooledCount, 1)
+		return nil
+	}
+	err := esClient.Index(sp.EsIndex, id, doc, create, st.esFailed)
+	if err != nil && retryable(err) && Spool.add(sp.TaskId, sp.EsIndex, id, create, doc) {
+		atomic.AddInt32(&st.SpooledCount, 1)
+		return nil
+	}
+	return err
+}
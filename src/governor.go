@@ -0,0 +1,42 @@
+package main
+
+import (
+	"sync"
+)
+
+// bufferGate 限制等待上传的检索结果占用的内存，超出时扫描协程阻塞等待上传完成
+type bufferGate struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	max   int64
+	inUse int64
+}
+
+func newBufferGate(max int64) *bufferGate {
+	bg := &bufferGate{max: max}
+	bg.cond = sync.NewCond(&bg.mu)
+	return bg
+}
+
+// acquire 占用n字节，max为0时不限制；单条超过max的记录在没有其他占用时放行
+func (bg *bufferGate) acquire(n int64) {
+	if bg.max <= 0 {
+		return
+	}
+	bg.mu.Lock()
+	for bg.inUse > 0 && bg.inUse+n > bg.max {
+		bg.cond.Wait()
+	}
+	bg.inUse += n
+	bg.mu.Unlock()
+}
+
+func (bg *bufferGate) release(n int64) {
+	if bg.max <= 0 {
+		return
+	}
+	bg.mu.Lock()
+	bg.inUse -= n
+	bg.mu.Unlock()
+	bg.cond.Broadcast()
+}
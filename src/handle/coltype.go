@@ -0,0 +1,51 @@
+package handle
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ColTypes logHeader中可以声明的列类型，未声明时为keyword
+var ColTypes = []string{"keyword", "long", "double", "ip", "date", "text"}
+
+// SplitColType 拆分logHeader中的"列名:类型"，未声明类型时返回keyword
+func SplitColType(v string) (name string, typ string) {
+	v = strings.TrimSpace(v)
+	if i := strings.LastIndex(v, ":"); i > 0 && InSlice(ColTypes, v[i+1:]) {
+		return v[:i], v[i+1:]
+	}
+	return v, "keyword"
+}
+
+// CoerceValue 按列类型转换值；date类型按日志的日期格式解析后输出为RFC3339。
+// 空值与"-"返回nil；无法转换时ok为false
+func CoerceValue(typ string, v string, dateFormat DateFormat) (ret interface{}, ok bool) {
+	if typ == "keyword" || typ == "text" {
+		return v, true
+	}
+	v = strings.TrimSpace(v)
+	if v == "" || v == "-" {
+		return nil, true
+	}
+	switch typ {
+	case "long":
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return n, true
+		}
+	case "double":
+		if n, err := strconv.ParseFloat(v, 64); err == nil {
+			return n, true
+		}
+	case "ip":
+		if ip := net.ParseIP(v); ip != nil {
+			return ip.String(), true
+		}
+	case "date":
+		if ts, err := dateFormat.Parse(v); err == nil {
+			return ts.Format(time.RFC3339Nano), true
+		}
+	}
+	return nil, false
+}
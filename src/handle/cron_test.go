@@ -0,0 +1,81 @@
+package handle
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	tests := []struct {
+		expr string
+		from string
+		want string
+	}{
+		{"*/5 * * * *", "2026-10-19 10:07:30", "2026-10-19 10:10"},
+		{"*/5 * * * *", "2026-10-19 10:10:00", "2026-10-19 10:15"},
+		{"0 * * * *", "2026-10-19 23:30:00", "2026-10-20 00:00"},
+		{"5/20 8-9 * * *", "2026-10-19 07:00:00", "2026-10-19 08:05"},
+		{"5/20 8-9 * * *", "2026-10-19 09:45:00", "2026-10-20 08:05"},
+		{"0 12 1,15 * *", "2026-10-15 12:00:00", "2026-11-01 12:00"},
+		// 跨月与跨年
+		{"30 2 31 * *", "2026-10-31 03:00:00", "2026-12-31 02:30"},
+		{"0 0 1 1 *", "2026-10-19 00:00:00", "2027-01-01 00:00"},
+		// 闰日
+		{"15 9 29 2 *", "2026-10-19 00:00:00", "2028-02-29 09:15"},
+		// 日与周都限定时满足其一即可
+		{"0 0 1,15 * 0", "2026-10-19 00:00:00", "2026-10-25 00:00"},
+		{"0 0 1,15 * 0", "2026-10-25 00:00:00", "2026-11-01 00:00"},
+		// 只限定周
+		{"0 0 * * 7", "2026-10-19 00:00:00", "2026-10-25 00:00"},
+		{"0 9 * * 1-5", "2026-10-23 10:00:00", "2026-10-26 09:00"},
+		// 只限定日
+		{"0 0 25 * *", "2026-10-19 00:00:00", "2026-10-25 00:00"},
+		{"@hourly", "2026-10-19 10:00:00", "2026-10-19 11:00"},
+		{"@daily", "2026-10-19 10:00:00", "2026-10-20 00:00"},
+		{"@weekly", "2026-10-19 10:00:00", "2026-10-25 00:00"},
+		{"@monthly", "2026-10-19 10:00:00", "2026-11-01 00:00"},
+	}
+	for _, tt := range tests {
+		c, err := ParseCron(tt.expr)
+		if err != nil {
+			t.Fatalf("ParseCron(%q): %s", tt.expr, err)
+		}
+		from, _ := time.ParseInLocation("2006-01-02 15:04:05", tt.from, time.UTC)
+		want, _ := time.ParseInLocation("2006-01-02 15:04", tt.want, time.UTC)
+		if got := c.Next(from); !got.Equal(want) {
+			t.Errorf("%q.Next(%s) = %s, want %s", tt.expr, tt.from, got.Format("2006-01-02 15:04"), tt.want)
+		}
+	}
+}
+
+func TestCronNextNever(t *testing.T) {
+	c, err := ParseCron("0 0 31 2 *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.Next(time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC)); !got.IsZero() {
+		t.Errorf("Next = %s, want zero time", got)
+	}
+}
+
+func TestParseCronInvalid(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"a * * * *",
+		"5-1 * * * *",
+		"1-a * * * *",
+		"@yearly",
+	} {
+		if _, err := ParseCron(expr); err == nil {
+			t.Errorf("ParseCron(%q): want error", expr)
+		}
+	}
+}
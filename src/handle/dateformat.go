@@ -0,0 +1,125 @@
+package handle
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DateFormat 解析后的日志时间格式，Layouts为Go时间模板（按顺序尝试），Epoch不为0时表示时间戳格式及其单位
+type DateFormat struct {
+	Layouts []string
+	Epoch   int64
+}
+
+// 内置的时间格式预设
+var datePresets = map[string]DateFormat{
+	"nginx":    {Layouts: []string{"02/Jan/2006:15:04:05 -0700", "02/Jan/2006:15:04:05"}},
+	"apache":   {Layouts: []string{"02/Jan/2006:15:04:05 -0700", "02/Jan/2006:15:04:05", "Mon Jan _2 15:04:05 2006"}},
+	"syslog":   {Layouts: []string{"Jan _2 15:04:05", time.RFC3339}},
+	"rfc3339":  {Layouts: []string{time.RFC3339}},
+	"iso8601":  {Layouts: []string{"2006-01-02T15:04:05Z07:00", "2006-01-02T15:04:05Z0700", "2006-01-02T15:04:05", "2006-01-02 15:04:05"}},
+	"epoch_s":  {Epoch: 1},
+	"epoch_ms": {Epoch: 1e3},
+	"epoch_us": {Epoch: 1e6},
+}
+
+// strftime指令与Go时间模板的对应关系
+var strftimeMap = map[byte]string{
+	'Y': "2006", 'y': "06", 'm': "01", 'd': "02", 'e': "_2", 'b': "Jan", 'h': "Jan", 'B': "January",
+	'a': "Mon", 'A': "Monday", 'H': "15", 'I': "03", 'M': "04", 'S': "05", 'p': "PM", 'z': "-0700",
+	'Z': "MST", 'j': "002", 'f': "000000", 'T': "15:04:05", 'D': "01/02/06", 'F': "2006-01-02",
+	'R': "15:04", '%': "%",
+}
+
+// NewDateFormat 把请求中的dateFormat转换为DateFormat，支持预设名称、strftime格式（含%）和Go时间模板
+func NewDateFormat(format string) (DateFormat, error) {
+	if preset, ok := datePresets[strings.ToLower(format)]; ok {
+		return preset, nil
+	}
+	if format == "%s" {
+		return datePresets["epoch_s"], nil
+	}
+	if !strings.Contains(format, "%") {
+		return DateFormat{Layouts: []string{format}}, nil
+	}
+	var layout strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			layout.WriteByte(format[i])
+			continue
+		}
+		if i == len(format)-1 {
+			return DateFormat{}, errors.New("dateFormat ends with a single %")
+		}
+		i++
+		v, ok := strftimeMap[format[i]]
+		if !ok {
+			return DateFormat{}, errors.New("unsupported strftime directive %" + string(format[i]))
+		}
+		layout.WriteString(v)
+	}
+	return DateFormat{Layouts: []string{layout.String()}}, nil
+}
+
+// Parse 解析日志中的时间字符串，自动去除两端的方括号；小数秒由time.Parse自动忽略模板中未声明的部分
+func (f DateFormat) Parse(dateStr string) (time.Time, error) {
+	dateStr = strings.Trim(strings.TrimSpace(dateStr), "[]")
+	if f.Epoch != 0 {
+		return parseEpoch(dateStr, f.Epoch)
+	}
+	var err error
+	for _, layout := range f.Layouts {
+		var stamp time.Time
+		stamp, err = time.ParseInLocation(layout, dateStr, time.Local)
+		if err == nil {
+			return stamp, nil
+		}
+	}
+	if err == nil {
+		err = errors.New("empty dateFormat")
+	}
+	return time.Time{}, err
+}
+
+// 解析时间戳字符串，unit为每秒的单位数，允许带小数部分
+func parseEpoch(dateStr string, unit int64) (time.Time, error) {
+	intPart, fracPart, _ := strings.Cut(dateStr, ".")
+	n, err := strconv.ParseInt(intPart, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var frac float64
+	if fracPart != "" {
+		frac, err = strconv.ParseFloat("0."+fracPart, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+	}
+	nsPerUnit := int64(time.Second) / unit
+	ns := n*nsPerUnit + int64(frac*float64(nsPerUnit))
+	return time.Unix(0, ns).In(time.Local), nil
+}
+
+// TimeParamToNano 把请求中的startTime/endTime转换为纳秒时间戳：
+// 大于1e11的值视为毫秒，否则视为秒（允许小数，精确到微秒）；isEnd为true时包含该时间精度内的全部时间
+func TimeParamToNano(v float64, isEnd bool) int64 {
+	var ns, unit int64
+	switch {
+	case v > 1e11:
+		ns, unit = int64(math.Round(v*1e3))*int64(time.Microsecond), int64(time.Millisecond)
+		if v != math.Trunc(v) {
+			unit = int64(time.Microsecond)
+		}
+	case v == math.Trunc(v):
+		ns, unit = int64(v)*int64(time.Second), int64(time.Second)
+	default:
+		ns, unit = int64(math.Round(v*1e6))*int64(time.Microsecond), int64(time.Microsecond)
+	}
+	if isEnd {
+		ns += unit - 1
+	}
+	return ns
+}
@@ -0,0 +1,100 @@
+package handle
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNewDateFormat(t *testing.T) {
+	tests := []struct {
+		format string
+		want   DateFormat
+	}{
+		{"nginx", datePresets["nginx"]},
+		{"RFC3339", datePresets["rfc3339"]},
+		{"epoch_ms", DateFormat{Epoch: 1e3}},
+		{"%s", DateFormat{Epoch: 1}},
+		{"2006-01-02 15:04:05", DateFormat{Layouts: []string{"2006-01-02 15:04:05"}}},
+		{"%Y-%m-%d %H:%M:%S", DateFormat{Layouts: []string{"2006-01-02 15:04:05"}}},
+		{"%d/%b/%Y:%T %z", DateFormat{Layouts: []string{"02/Jan/2006:15:04:05 -0700"}}},
+		{"%F %T.%f", DateFormat{Layouts: []string{"2006-01-02 15:04:05.000000"}}},
+		{"%e %B %y %I:%M %p", DateFormat{Layouts: []string{"_2 January 06 03:04 PM"}}},
+		{"100%% %D %R", DateFormat{Layouts: []string{"100% 01/02/06 15:04"}}},
+	}
+	for _, tt := range tests {
+		got, err := NewDateFormat(tt.format)
+		if err != nil {
+			t.Errorf("NewDateFormat(%q): %s", tt.format, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("NewDateFormat(%q) = %+v, want %+v", tt.format, got, tt.want)
+		}
+	}
+	for _, format := range []string{"%Y-%m-%d %", "%Y %Q"} {
+		if _, err := NewDateFormat(format); err == nil {
+			t.Errorf("NewDateFormat(%q): want error", format)
+		}
+	}
+}
+
+func TestDateFormatParse(t *testing.T) {
+	tests := []struct {
+		format string
+		value  string
+		want   time.Time
+	}{
+		{"nginx", "[19/Oct/2026:10:07:30 +0000]", time.Date(2026, 10, 19, 10, 7, 30, 0, time.UTC)},
+		{"nginx", "19/Oct/2026:10:07:30", time.Date(2026, 10, 19, 10, 7, 30, 0, time.Local)},
+		{"syslog", "Oct  9 10:07:30", time.Date(0, 10, 9, 10, 7, 30, 0, time.Local)},
+		{"%Y-%m-%d %H:%M:%S", " 2026-10-19 10:07:30 ", time.Date(2026, 10, 19, 10, 7, 30, 0, time.Local)},
+		{"%Y-%m-%d %H:%M:%S", "2026-10-19 10:07:30.250", time.Date(2026, 10, 19, 10, 7, 30, 250e6, time.Local)},
+		{"epoch_s", "1760868450", time.Unix(1760868450, 0)},
+		{"epoch_s", "1760868450.25", time.Unix(1760868450, 250e6)},
+		{"epoch_ms", "1760868450123", time.Unix(1760868450, 123e6)},
+		{"epoch_ms", "1760868450123.5", time.Unix(1760868450, 123500e3)},
+		{"epoch_us", "1760868450123456", time.Unix(1760868450, 123456e3)},
+	}
+	for _, tt := range tests {
+		f, _ := NewDateFormat(tt.format)
+		got, err := f.Parse(tt.value)
+		if err != nil {
+			t.Errorf("%s Parse(%q): %s", tt.format, tt.value, err)
+			continue
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("%s Parse(%q) = %s, want %s", tt.format, tt.value, got, tt.want)
+		}
+	}
+	for _, tt := range [][2]string{{"epoch_s", "abc"}, {"epoch_ms", "12.x"}, {"nginx", "2026-10-19"}} {
+		f, _ := NewDateFormat(tt[0])
+		if _, err := f.Parse(tt[1]); err == nil {
+			t.Errorf("%s Parse(%q): want error", tt[0], tt[1])
+		}
+	}
+}
+
+func TestTimeParamToNano(t *testing.T) {
+	tests := []struct {
+		name  string
+		v     float64
+		isEnd bool
+		want  int64
+	}{
+		{"seconds start", 1760868450, false, 1760868450 * int64(time.Second)},
+		{"seconds end covers the whole second", 1760868450, true, 1760868451*int64(time.Second) - 1},
+		{"milliseconds start", 1760868450123, false, 1760868450123 * int64(time.Millisecond)},
+		{"milliseconds end covers the whole millisecond", 1760868450123, true, 1760868450124*int64(time.Millisecond) - 1},
+		{"fractional seconds", 1760868450.5, false, 1760868450500000 * int64(time.Microsecond)},
+		{"fractional seconds end", 1760868450.5, true, 1760868450500001*int64(time.Microsecond) - 1},
+		{"fractional milliseconds", 1760868450123.5, false, 1760868450123500 * int64(time.Microsecond)},
+		{"fractional milliseconds end", 1760868450123.5, true, 1760868450123501*int64(time.Microsecond) - 1},
+		{"above 1e11 treated as milliseconds", 1e11 + 1, false, (1e11 + 1) * int64(time.Millisecond)},
+	}
+	for _, tt := range tests {
+		if got := TimeParamToNano(tt.v, tt.isEnd); got != tt.want {
+			t.Errorf("%s: TimeParamToNano(%v, %v) = %d, want %d", tt.name, tt.v, tt.isEnd, got, tt.want)
+		}
+	}
+}
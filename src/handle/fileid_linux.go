@@ -0,0 +1,17 @@
+package handle
+
+import (
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// FileId 文件的唯一标识：设备号与inode，文件被重命名（如日志轮转）后不变；无法获取时返回文件的绝对路径
+func FileId(file *os.File) string {
+	if info, err := file.Stat(); err == nil {
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			return strconv.FormatUint(uint64(st.Dev), 10) + ":" + strconv.FormatUint(st.Ino, 10)
+		}
+	}
+	return absPath(file.Name())
+}
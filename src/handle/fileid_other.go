@@ -0,0 +1,10 @@
+//go:build !linux
+
+package handle
+
+import "os"
+
+// FileId 非Linux系统使用文件的绝对路径作为文件标识
+func FileId(file *os.File) string {
+	return absPath(file.Name())
+}
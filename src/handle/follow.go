@@ -0,0 +1,151 @@
+package handle
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+// Follower 跟踪一个日志文件新写入的行（类似tail -F）。每次Poll读取上次之后新写入的完整行，
+// 路径指向的文件发生变化（日志轮转）时读完旧文件后从头读取新文件，文件被截断时从头读取。
+// 超过MaxLen字节的行只保留前MaxLen字节，未以换行结尾的部分等到下次写入完整后再返回
+type Follower struct {
+	Path   string
+	MaxLen int
+	file   *os.File
+	info   os.FileInfo
+	// 已读取的字节数，即下一次读取的位置
+	pos int64
+	// 当前未读完的一行，start为其起始偏移，long表示已超过MaxLen
+	buf   []byte
+	start int64
+	long  bool
+	chunk []byte
+}
+
+// NewFollower 打开日志文件，fromEnd为true时从文件末尾开始跟踪
+func NewFollower(path string, fromEnd bool, maxLen int) (*Follower, error) {
+	f := &Follower{Path: path, MaxLen: maxLen, chunk: make([]byte, 64*1024)}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	if fromEnd {
+		pos, err := f.file.Seek(0, io.SeekEnd)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		f.pos, f.start = pos, pos
+	}
+	return f, nil
+}
+
+func (f *Follower) open() error {
+	file, err := os.Open(f.Path)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	if f.file != nil {
+		_ = f.file.Close()
+	}
+	f.file, f.info = file, info
+	f.reset(0)
+	return nil
+}
+
+// 从pos处重新开始读取，丢弃未读完的行
+func (f *Follower) reset(pos int64) {
+	f.pos, f.start = pos, pos
+	f.buf, f.long = f.buf[:0], false
+}
+
+// Id 正在读取的文件的唯一标识，见FileId
+func (f *Follower) Id() string {
+	return FileId(f.file)
+}
+
+// Poll 读取新写入的完整行，依次以行内容（不含换行符）、行起始偏移与是否被截断回调fn；
+// 文件被轮转或截断时切换到新文件或从头读取，fn返回false时停止读取
+func (f *Follower) Poll(fn func(line string, offset int64, truncated bool) bool) error {
+	for {
+		if !f.drain(fn) {
+			return nil
+		}
+		info, err := os.Stat(f.Path)
+		if err != nil {
+			// 轮转时新文件可能还未创建，下次再检查
+			return nil
+		}
+		if !os.SameFile(info, f.info) {
+			if err = f.open(); err != nil {
+				return err
+			}
+			continue
+		}
+		if info.Size() < f.pos {
+			if _, err = f.file.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			f.reset(0)
+			continue
+		}
+		return nil
+	}
+}
+
+// 读到当前文件末尾，fn返回false时返回false
+func (f *Follower) drain(fn func(line string, offset int64, truncated bool) bool) bool {
+	for {
+		n, err := f.file.Read(f.chunk)
+		data := f.chunk[:n]
+		for len(data) > 0 {
+			i := bytes.IndexByte(data, '\n')
+			frag := data
+			if i >= 0 {
+				frag = data[:i]
+			}
+			if !f.long {
+				if f.MaxLen > 0 && len(f.buf)+len(frag) > f.MaxLen {
+					f.buf = append(f.buf, frag[:f.MaxLen-len(f.buf)]...)
+					f.long = true
+				} else {
+					f.buf = append(f.buf, frag...)
+				}
+			}
+			if i < 0 {
+				f.pos += int64(len(data))
+				break
+			}
+			f.pos += int64(i + 1)
+			data = data[i+1:]
+			line := f.buf
+			if len(line) > 0 && line[len(line)-1] == '\r' {
+				line = line[:len(line)-1]
+			}
+			ok := fn(string(line), f.start, f.long)
+			f.buf, f.long, f.start = f.buf[:0], false, f.pos
+			if !ok {
+				// 本块剩余的内容下次重新读取
+				if len(data) > 0 {
+					_, _ = f.file.Seek(f.pos, io.SeekStart)
+				}
+				return false
+			}
+		}
+		if err != nil || n == 0 {
+			return true
+		}
+	}
+}
+
+// Close 关闭正在读取的文件
+func (f *Follower) Close() {
+	if f.file != nil {
+		_ = f.file.Close()
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
 	"runtime/debug"
 	"time"
 )
@@ -96,17 +97,55 @@ func GetAllFile(pathname string, s []string) ([]string, error) {
 	return s, nil
 }
 
-// FillYear 年份未知时补全年份
-func FillYear(stamp time.Time) int64 {
-	if stamp.Year() == 0 {
-		nowStamp := time.Now()
-		var y int
-		if stamp.Month() > nowStamp.Month() {
-			y = nowStamp.Year() - 1
-		} else {
-			y = nowStamp.Year()
+// YearAnchor 补全年份时的参考：检索时间窗口（纳秒时间戳）和日志文件的修改时间，Now为零值时取当前时间
+type YearAnchor struct {
+	Start   int64
+	End     int64
+	ModTime time.Time
+	Now     time.Time
+}
+
+// 日志时间允许超前于文件修改时间（或当前时间）的范围，用于兼容时钟偏差
+const yearSkew = 24 * time.Hour
+
+// FillYear 年份未知时补全年份，返回纳秒时间戳。
+// 在参考年份的前一年、当年、后一年中，排除晚于文件修改时间（无则为当前时间）超过yearSkew的候选，
+// 再选择距离检索时间窗口最近的一个，距离相同时取较晚的年份
+func FillYear(stamp time.Time, anchor YearAnchor) int64 {
+	if stamp.Year() != 0 {
+		return stamp.UnixNano()
+	}
+	upper := anchor.Now
+	if upper.IsZero() {
+		upper = time.Now()
+	}
+	if !anchor.ModTime.IsZero() && anchor.ModTime.Before(upper) {
+		upper = anchor.ModTime
+	}
+	upperTs := upper.Add(yearSkew).UnixNano()
+	var best int64
+	var bestDist int64 = -1
+	for y := upper.Year() - 1; y <= upper.Year()+1; y++ {
+		ts := stamp.AddDate(y, 0, 0).UnixNano()
+		if ts > upperTs {
+			continue
 		}
-		stamp = stamp.AddDate(y, 0, 0)
+		var dist int64
+		if ts < anchor.Start {
+			dist = anchor.Start - ts
+		} else if anchor.End != 0 && ts > anchor.End {
+			dist = ts - anchor.End
+		}
+		if bestDist < 0 || dist <= bestDist {
+			best, bestDist = ts, dist
+		}
+	}
+	return best
+}
+
+func absPath(name string) string {
+	if abs, err := filepath.Abs(name); err == nil {
+		return abs
 	}
-	return stamp.Unix()
+	return name
 }
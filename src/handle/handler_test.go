@@ -0,0 +1,92 @@
+package handle
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFillYear(t *testing.T) {
+	at := func(year int, month time.Month, day, hour, min int) time.Time {
+		return time.Date(year, month, day, hour, min, 0, 0, time.Local)
+	}
+	tests := []struct {
+		name    string
+		stamp   time.Time
+		start   time.Time
+		end     time.Time
+		modTime time.Time
+		now     time.Time
+		want    time.Time
+	}{
+		{
+			name:  "year known",
+			stamp: at(2024, 5, 1, 8, 0),
+			start: at(2026, 10, 19, 0, 0), end: at(2026, 10, 19, 23, 59),
+			now:  at(2026, 10, 19, 12, 0),
+			want: at(2024, 5, 1, 8, 0),
+		},
+		{
+			name:  "same day",
+			stamp: at(0, 10, 19, 10, 0),
+			start: at(2026, 10, 19, 0, 0), end: at(2026, 10, 19, 23, 59),
+			now:  at(2026, 10, 19, 12, 0),
+			want: at(2026, 10, 19, 10, 0),
+		},
+		{
+			name:  "dec 31 searched on jan 1",
+			stamp: at(0, 12, 31, 23, 50),
+			start: at(2026, 12, 31, 23, 0), end: at(2027, 1, 1, 1, 0),
+			now:  at(2027, 1, 1, 0, 10),
+			want: at(2026, 12, 31, 23, 50),
+		},
+		{
+			name:  "jan 1 line in window across new year",
+			stamp: at(0, 1, 1, 0, 5),
+			start: at(2026, 12, 31, 23, 0), end: at(2027, 1, 1, 1, 0),
+			now:  at(2027, 1, 1, 0, 10),
+			want: at(2027, 1, 1, 0, 5),
+		},
+		{
+			name:  "clock skewed future line within skew",
+			stamp: at(0, 10, 19, 12, 30),
+			start: at(2026, 10, 19, 0, 0), end: at(2026, 10, 19, 12, 0),
+			now:  at(2026, 10, 19, 12, 0),
+			want: at(2026, 10, 19, 12, 30),
+		},
+		{
+			name:  "future candidate excluded",
+			stamp: at(0, 12, 25, 8, 0),
+			start: at(2025, 12, 20, 0, 0), end: at(2025, 12, 31, 0, 0),
+			now:  at(2026, 10, 19, 12, 0),
+			want: at(2025, 12, 25, 8, 0),
+		},
+		{
+			name:  "file modified earlier than now",
+			stamp: at(0, 12, 30, 8, 0),
+			start: at(2026, 1, 1, 0, 0), end: at(2026, 1, 31, 0, 0),
+			modTime: at(2026, 1, 2, 0, 0),
+			now:     at(2026, 10, 19, 12, 0),
+			want:    at(2025, 12, 30, 8, 0),
+		},
+		{
+			name:  "open window prefers later year",
+			stamp: at(0, 3, 1, 8, 0),
+			now:   at(2026, 10, 19, 12, 0),
+			want:  at(2026, 3, 1, 8, 0),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			anchor := YearAnchor{ModTime: tt.modTime, Now: tt.now}
+			if !tt.start.IsZero() {
+				anchor.Start = tt.start.UnixNano()
+			}
+			if !tt.end.IsZero() {
+				anchor.End = tt.end.UnixNano()
+			}
+			if got := FillYear(tt.stamp, anchor); got != tt.want.UnixNano() {
+				t.Errorf("FillYear = %s, want %s", time.Unix(0, got).In(time.Local), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package handle
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+func TestHyperLogLogCount(t *testing.T) {
+	tests := []struct {
+		name     string
+		p        uint8
+		distinct int
+		repeat   int
+		// 允许的相对误差
+		tolerance float64
+	}{
+		{"empty", 14, 0, 1, 0},
+		{"one", 14, 1, 1, 0},
+		{"small", 14, 10, 1, 0},
+		{"duplicates", 14, 100, 50, 0.02},
+		{"linear counting", 14, 1000, 1, 0.02},
+		{"large", 14, 200000, 1, 0.03},
+		{"low precision", 10, 50000, 1, 0.1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHyperLogLog(tt.p)
+			for r := 0; r < tt.repeat; r++ {
+				for i := 0; i < tt.distinct; i++ {
+					h.Add("value-" + strconv.Itoa(i))
+				}
+			}
+			got := float64(h.Count())
+			want := float64(tt.distinct)
+			if tt.tolerance == 0 {
+				if got != want {
+					t.Errorf("Count() = %v, want %v", got, want)
+				}
+				return
+			}
+			if err := math.Abs(got-want) / want; err > tt.tolerance {
+				t.Errorf("Count() = %v, want %v ±%.0f%% (error %.2f%%)", got, want, tt.tolerance*100, err*100)
+			}
+		})
+	}
+}
+
+func TestHyperLogLogAddIdempotent(t *testing.T) {
+	h := NewHyperLogLog(14)
+	h.Add("a")
+	registers := append([]uint8(nil), h.registers...)
+	for i := 0; i < 10; i++ {
+		h.Add("a")
+	}
+	for i := range registers {
+		if registers[i] != h.registers[i] {
+			t.Fatalf("register %d changed after adding a duplicate value", i)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package handle
+
+import (
+	"bufio"
+	"io"
+)
+
+// LineReader 按行读取日志文件，超过MaxLen字节的行只保留前MaxLen字节，其余部分丢弃到行尾。
+// Offset与LineNo为最近读取的一行在文件（压缩文件为解压后）中的起始字节偏移与行号（从1开始）
+type LineReader struct {
+	br     *bufio.Reader
+	MaxLen int
+	Offset int64
+	LineNo int64
+	pos    int64
+}
+
+func NewLineReader(r io.Reader, maxLen int) *LineReader {
+	return &LineReader{br: bufio.NewReaderSize(r, 64*1024), MaxLen: maxLen}
+}
+
+// ReadLine 读取一行（不含换行符），truncated表示该行超长被截断；文件读完时返回io.EOF
+func (lr *LineReader) ReadLine() (line string, truncated bool, err error) {
+	var buf []byte
+	start := lr.pos
+	for {
+		frag, e := lr.br.ReadSlice('\n')
+		lr.pos += int64(len(frag))
+		if e == nil {
+			frag = frag[:len(frag)-1]
+		}
+		if !truncated {
+			if lr.MaxLen > 0 && len(buf)+len(frag) > lr.MaxLen {
+				buf = append(buf, frag[:lr.MaxLen-len(buf)]...)
+				truncated = true
+			} else {
+				buf = append(buf, frag...)
+			}
+		}
+		if e == bufio.ErrBufferFull {
+			continue
+		}
+		if e != nil && len(buf) == 0 && !truncated {
+			return "", false, e
+		}
+		if len(buf) > 0 && buf[len(buf)-1] == '\r' {
+			buf = buf[:len(buf)-1]
+		}
+		lr.Offset = start
+		lr.LineNo++
+		return string(buf), truncated, nil
+	}
+}
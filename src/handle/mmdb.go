@@ -0,0 +1,276 @@
+package handle
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/big"
+	"net"
+	"os"
+)
+
+// MaxMind DB文件元数据的起始标记
+var mmdbMetaMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// MMDB MaxMind DB格式（GeoLite2/GeoIP2等）的只读查询，整个文件读入内存
+type MMDB struct {
+	buf        []byte
+	data       []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	ipv4Start  uint
+	Type       string
+}
+
+// OpenMMDB 读取并解析mmdb文件
+func OpenMMDB(path string) (*MMDB, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	i := bytes.LastIndex(buf, mmdbMetaMarker)
+	if i < 0 {
+		return nil, errors.New("invalid mmdb file: metadata not found")
+	}
+	metaBuf := buf[i+len(mmdbMetaMarker):]
+	meta, _, err := (&mmdbDecoder{buf: metaBuf}).decode(0)
+	if err != nil {
+		return nil, err
+	}
+	metaMap, ok := meta.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("invalid mmdb metadata")
+	}
+	db := &MMDB{buf: buf}
+	db.nodeCount = uint(toUint64(metaMap["node_count"]))
+	db.recordSize = uint(toUint64(metaMap["record_size"]))
+	db.ipVersion = uint(toUint64(metaMap["ip_version"]))
+	db.Type, _ = metaMap["database_type"].(string)
+	if db.recordSize != 24 && db.recordSize != 28 && db.recordSize != 32 {
+		return nil, errors.New("unsupported mmdb record size")
+	}
+	treeSize := db.recordSize * 2 / 8 * db.nodeCount
+	if treeSize+16 > uint(i) {
+		return nil, errors.New("invalid mmdb search tree size")
+	}
+	db.data = buf[treeSize+16 : i]
+	// IPv6数据库中IPv4地址位于::/96子树下
+	if db.ipVersion == 6 {
+		node := uint(0)
+		for j := 0; j < 96 && node < db.nodeCount; j++ {
+			node = db.readNode(node, 0)
+		}
+		db.ipv4Start = node
+	}
+	return db, nil
+}
+
+func toUint64(v interface{}) uint64 {
+	switch n := v.(type) {
+	case uint64:
+		return n
+	case uint32:
+		return uint64(n)
+	case uint16:
+		return uint64(n)
+	case int32:
+		return uint64(n)
+	}
+	return 0
+}
+
+// 读取节点的左（bit=0）或右（bit=1）记录
+func (db *MMDB) readNode(node uint, bit uint) uint {
+	switch db.recordSize {
+	case 24:
+		off := node*6 + bit*3
+		b := db.buf[off : off+3]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		off := node * 7
+		b := db.buf[off : off+7]
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		off := node*8 + bit*4
+		return uint(binary.BigEndian.Uint32(db.buf[off : off+4]))
+	}
+}
+
+// Lookup 查询IP对应的记录，未找到时返回nil
+func (db *MMDB) Lookup(ip net.IP) (map[string]interface{}, error) {
+	var node uint
+	bitCount := 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		bitCount = 32
+		if db.ipVersion == 6 {
+			node = db.ipv4Start
+		}
+	} else if db.ipVersion == 4 {
+		return nil, nil
+	}
+	for i := 0; i < bitCount && node < db.nodeCount; i++ {
+		bit := uint(ip[i>>3]>>(7-uint(i&7))) & 1
+		node = db.readNode(node, bit)
+	}
+	if node == db.nodeCount {
+		return nil, nil
+	}
+	if node < db.nodeCount {
+		return nil, errors.New("invalid mmdb search tree")
+	}
+	offset := node - db.nodeCount - 16
+	v, _, err := (&mmdbDecoder{buf: db.data}).decode(offset)
+	if err != nil {
+		return nil, err
+	}
+	ret, _ := v.(map[string]interface{})
+	return ret, nil
+}
+
+// mmdbDecoder 数据段解码器，指针为相对buf起始的偏移
+type mmdbDecoder struct {
+	buf []byte
+}
+
+var errMmdbData = errors.New("invalid mmdb data section")
+
+func (d *mmdbDecoder) bytesAt(offset uint, n uint) ([]byte, error) {
+	if offset+n > uint(len(d.buf)) {
+		return nil, errMmdbData
+	}
+	return d.buf[offset : offset+n], nil
+}
+
+// decode 解码offset处的一个值，返回值与下一个值的偏移
+func (d *mmdbDecoder) decode(offset uint) (interface{}, uint, error) {
+	b, err := d.bytesAt(offset, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	ctrl := b[0]
+	offset++
+	typ := uint(ctrl >> 5)
+	if typ == 1 {
+		// 指针：解码指向的值后，从指针之后继续
+		ss := uint(ctrl>>3) & 3
+		pb, err := d.bytesAt(offset, ss+1)
+		if err != nil {
+			return nil, 0, err
+		}
+		var p uint
+		switch ss {
+		case 0:
+			p = uint(ctrl&7)<<8 | uint(pb[0])
+		case 1:
+			p = (uint(ctrl&7)<<16 | uint(pb[0])<<8 | uint(pb[1])) + 2048
+		case 2:
+			p = (uint(ctrl&7)<<24 | uint(pb[0])<<16 | uint(pb[1])<<8 | uint(pb[2])) + 526336
+		default:
+			p = uint(binary.BigEndian.Uint32(pb))
+		}
+		v, _, err := d.decode(p)
+		return v, offset + ss + 1, err
+	}
+	if typ == 0 {
+		eb, err := d.bytesAt(offset, 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		typ = 7 + uint(eb[0])
+		offset++
+	}
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		sb, err := d.bytesAt(offset, n)
+		if err != nil {
+			return nil, 0, err
+		}
+		var ext uint
+		for _, c := range sb {
+			ext = ext<<8 | uint(c)
+		}
+		size = [...]uint{29, 285, 65821}[n-1] + ext
+		offset += n
+	}
+	switch typ {
+	case 2:
+		s, err := d.bytesAt(offset, size)
+		return string(s), offset + size, err
+	case 3:
+		s, err := d.bytesAt(offset, 8)
+		if err != nil {
+			return nil, 0, err
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(s)), offset + 8, nil
+	case 4:
+		s, err := d.bytesAt(offset, size)
+		return append([]byte(nil), s...), offset + size, err
+	case 5, 6, 8, 9:
+		s, err := d.bytesAt(offset, size)
+		if err != nil {
+			return nil, 0, err
+		}
+		var n uint64
+		for _, c := range s {
+			n = n<<8 | uint64(c)
+		}
+		switch typ {
+		case 5:
+			return uint16(n), offset + size, nil
+		case 6:
+			return uint32(n), offset + size, nil
+		case 8:
+			return int32(uint32(n)), offset + size, nil
+		}
+		return n, offset + size, nil
+	case 10:
+		s, err := d.bytesAt(offset, size)
+		if err != nil {
+			return nil, 0, err
+		}
+		return new(big.Int).SetBytes(s), offset + size, nil
+	case 7:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			k, next, err := d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			v, next2, err := d.decode(next)
+			if err != nil {
+				return nil, 0, err
+			}
+			ks, _ := k.(string)
+			m[ks] = v
+			offset = next2
+		}
+		return m, offset, nil
+	case 11:
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			v, next, err := d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+			offset = next
+		}
+		return a, offset, nil
+	case 14:
+		return size != 0, offset, nil
+	case 15:
+		s, err := d.bytesAt(offset, 4)
+		if err != nil {
+			return nil, 0, err
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(s))), offset + 4, nil
+	}
+	return nil, 0, errMmdbData
+}
@@ -0,0 +1,320 @@
+package handle
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// 按MaxMind DB格式编码控制字节与长度
+func mmdbCtrl(typ int, size int) []byte {
+	var ext []byte
+	switch {
+	case size < 29:
+	case size < 285:
+		ext = []byte{byte(size - 29)}
+		size = 29
+	default:
+		n := size - 285
+		ext = []byte{byte(n >> 8), byte(n)}
+		size = 30
+	}
+	var b []byte
+	if typ <= 7 {
+		b = []byte{byte(typ<<5 | size)}
+	} else {
+		b = []byte{byte(size), byte(typ - 7)}
+	}
+	return append(b, ext...)
+}
+
+type mmdbPointer uint
+
+// 编码测试用的值
+func mmdbEncode(v interface{}) []byte {
+	switch val := v.(type) {
+	case mmdbPointer:
+		p := uint(val)
+		switch {
+		case p < 2048:
+			return []byte{byte(1<<5 | p>>8), byte(p)}
+		case p < 526336:
+			p -= 2048
+			return []byte{byte(1<<5 | 1<<3 | p>>16), byte(p >> 8), byte(p)}
+		default:
+			p -= 526336
+			return []byte{byte(1<<5 | 2<<3 | p>>24), byte(p >> 16), byte(p >> 8), byte(p)}
+		}
+	case string:
+		return append(mmdbCtrl(2, len(val)), val...)
+	case float64:
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, math.Float64bits(val))
+		return append(mmdbCtrl(3, 8), b...)
+	case []byte:
+		return append(mmdbCtrl(4, len(val)), val...)
+	case uint16:
+		return append(mmdbCtrl(5, 2), byte(val>>8), byte(val))
+	case uint32:
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, val)
+		return append(mmdbCtrl(6, 4), b...)
+	case int32:
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, uint32(val))
+		return append(mmdbCtrl(8, 4), b...)
+	case uint64:
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, val)
+		return append(mmdbCtrl(9, 8), b...)
+	case bool:
+		if val {
+			return mmdbCtrl(14, 1)
+		}
+		return mmdbCtrl(14, 0)
+	case float32:
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, math.Float32bits(val))
+		return append(mmdbCtrl(15, 4), b...)
+	case []interface{}:
+		b := mmdbCtrl(11, len(val))
+		for _, e := range val {
+			b = append(b, mmdbEncode(e)...)
+		}
+		return b
+	case map[string]interface{}:
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		b := mmdbCtrl(7, len(val))
+		for _, k := range keys {
+			b = append(b, mmdbEncode(k)...)
+			b = append(b, mmdbEncode(val[k])...)
+		}
+		return b
+	}
+	panic("unsupported value")
+}
+
+func TestMmdbDecode(t *testing.T) {
+	long := string(bytes.Repeat([]byte("x"), 300))
+	tests := []struct {
+		name string
+		v    interface{}
+	}{
+		{"string", "CN"},
+		{"empty string", ""},
+		{"extended size string", long},
+		{"double", 31.5},
+		{"bytes", []byte{1, 2, 3}},
+		{"uint16", uint16(443)},
+		{"uint32", uint32(4134)},
+		{"int32", int32(-7)},
+		{"uint64", uint64(1) << 40},
+		{"true", true},
+		{"false", false},
+		{"float", float32(1.5)},
+		{"array", []interface{}{"a", uint32(1)}},
+		{"map", map[string]interface{}{"country": map[string]interface{}{"iso_code": "US"}, "asn": uint32(15169)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := mmdbEncode(tt.v)
+			got, next, err := (&mmdbDecoder{buf: buf}).decode(0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := tt.v
+			if f, ok := want.(float32); ok {
+				want = float64(f)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("decode = %#v, want %#v", got, want)
+			}
+			if next != uint(len(buf)) {
+				t.Errorf("next offset = %d, want %d", next, len(buf))
+			}
+		})
+	}
+}
+
+func TestMmdbDecodeUint128(t *testing.T) {
+	buf := append([]byte{16, 3}, bytes.Repeat([]byte{0xff}, 16)...)
+	got, _, err := (&mmdbDecoder{buf: buf}).decode(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 128), big.NewInt(1))
+	if got.(*big.Int).Cmp(want) != 0 {
+		t.Errorf("decode = %v, want %v", got, want)
+	}
+}
+
+func TestMmdbDecodePointer(t *testing.T) {
+	// 不同长度的指针都指向同一个字符串，解码后从指针之后继续
+	for _, target := range []uint{10, 3000, 600000} {
+		buf := make([]byte, target)
+		buf = append(buf, mmdbEncode("shared")...)
+		start := uint(len(buf))
+		ptr := mmdbEncode(mmdbPointer(target))
+		buf = append(buf, mmdbCtrl(11, 2)...)
+		buf = append(buf, ptr...)
+		buf = append(buf, ptr...)
+		got, next, err := (&mmdbDecoder{buf: buf}).decode(start)
+		if err != nil {
+			t.Fatalf("pointer to %d: %s", target, err)
+		}
+		if want := []interface{}{"shared", "shared"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("pointer to %d: decode = %#v, want %#v", target, got, want)
+		}
+		if next != uint(len(buf)) {
+			t.Errorf("pointer to %d: next offset = %d, want %d", target, next, len(buf))
+		}
+	}
+}
+
+func TestMmdbDecodeTruncated(t *testing.T) {
+	for _, v := range []interface{}{"abcdef", 1.5, uint32(70000), map[string]interface{}{"a": "b"}, mmdbPointer(100)} {
+		buf := mmdbEncode(v)
+		if _, _, err := (&mmdbDecoder{buf: buf[:len(buf)-1]}).decode(0); err == nil {
+			t.Errorf("decode truncated %#v: want error", v)
+		}
+	}
+}
+
+// 测试用的mmdb：按前缀建立搜索树（记录长度24位），数据段中每个前缀一条记录
+func buildMmdb(t *testing.T, ipVersion int, records map[string]map[string]interface{}) string {
+	type node struct{ rec [2]int }
+	const empty, dataRec = -1, -2
+	nodes := []*node{{rec: [2]int{empty, empty}}}
+	var data []byte
+	leaf := map[[2]int]int{}
+	for cidr, rec := range records {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ip := ipNet.IP
+		ones, _ := ipNet.Mask.Size()
+		if ipVersion == 6 && ip.To4() != nil {
+			ip, ones = ip.To16(), ones+96
+			copy(ip[10:12], []byte{0, 0})
+		} else if ip.To4() != nil {
+			ip = ip.To4()
+		}
+		n := 0
+		for i := 0; i < ones; i++ {
+			bit := int(ip[i>>3]>>(7-uint(i&7))) & 1
+			if i == ones-1 {
+				leaf[[2]int{n, bit}] = len(data)
+				nodes[n].rec[bit] = dataRec
+				break
+			}
+			if nodes[n].rec[bit] == empty {
+				nodes = append(nodes, &node{rec: [2]int{empty, empty}})
+				nodes[n].rec[bit] = len(nodes) - 1
+			}
+			n = nodes[n].rec[bit]
+		}
+		data = append(data, mmdbEncode(rec)...)
+	}
+	var buf []byte
+	for i, nd := range nodes {
+		for bit, r := range nd.rec {
+			v := r
+			switch r {
+			case empty:
+				v = len(nodes)
+			case dataRec:
+				v = len(nodes) + 16 + leaf[[2]int{i, bit}]
+			}
+			buf = append(buf, byte(v>>16), byte(v>>8), byte(v))
+		}
+	}
+	buf = append(buf, make([]byte, 16)...)
+	buf = append(buf, data...)
+	buf = append(buf, mmdbMetaMarker...)
+	buf = append(buf, mmdbEncode(map[string]interface{}{
+		"node_count":    uint32(len(nodes)),
+		"record_size":   uint16(24),
+		"ip_version":    uint16(ipVersion),
+		"database_type": "Test-City",
+	})...)
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	if err := os.WriteFile(path, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestMmdbLookup(t *testing.T) {
+	records := map[string]map[string]interface{}{
+		"1.2.3.0/24":    {"country": map[string]interface{}{"iso_code": "CN"}, "asn": uint32(4134)},
+		"8.8.0.0/16":    {"country": map[string]interface{}{"iso_code": "US"}, "asn": uint32(15169)},
+		"2001:db8::/32": {"country": map[string]interface{}{"iso_code": "JP"}},
+	}
+	tests := []struct {
+		ipVersion int
+		ip        string
+		iso       string
+	}{
+		{4, "1.2.3.4", "CN"},
+		{4, "1.2.4.4", ""},
+		{4, "8.8.8.8", "US"},
+		{4, "2001:db8::1", ""},
+		{6, "1.2.3.255", "CN"},
+		{6, "8.8.255.1", "US"},
+		{6, "9.9.9.9", ""},
+		{6, "2001:db8:1::1", "JP"},
+		{6, "2001:db9::1", ""},
+	}
+	dbs := map[int]*MMDB{}
+	for _, v := range []int{4, 6} {
+		recs := map[string]map[string]interface{}{}
+		for k, r := range records {
+			if v == 6 || net.ParseIP(k[:len(k)-3]).To4() != nil {
+				recs[k] = r
+			}
+		}
+		db, err := OpenMMDB(buildMmdb(t, v, recs))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if db.Type != "Test-City" {
+			t.Errorf("Type = %q", db.Type)
+		}
+		dbs[v] = db
+	}
+	for _, tt := range tests {
+		rec, err := dbs[tt.ipVersion].Lookup(net.ParseIP(tt.ip))
+		if err != nil {
+			t.Fatalf("IPv%d Lookup(%s): %s", tt.ipVersion, tt.ip, err)
+		}
+		var iso string
+		if rec != nil {
+			iso, _ = rec["country"].(map[string]interface{})["iso_code"].(string)
+		}
+		if iso != tt.iso {
+			t.Errorf("IPv%d Lookup(%s) country = %q, want %q", tt.ipVersion, tt.ip, iso, tt.iso)
+		}
+	}
+}
+
+func TestOpenMMDBInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bad.mmdb")
+	if err := os.WriteFile(path, []byte("not a database"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenMMDB(path); err == nil {
+		t.Error("OpenMMDB: want error for a file without metadata")
+	}
+}
@@ -0,0 +1,61 @@
+package handle
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// RateLimiter 令牌桶限速器，多个读取者共享同一个速率，rate为每秒允许的字节数，0表示不限速
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   int64
+	tokens int64
+	last   time.Time
+}
+
+func NewRateLimiter(rate int64) *RateLimiter {
+	return &RateLimiter{rate: rate, tokens: rate, last: time.Now()}
+}
+
+// Wait 占用n个字节的额度，额度不足时等待
+func (rl *RateLimiter) Wait(n int) {
+	if rl == nil || rl.rate <= 0 || n <= 0 {
+		return
+	}
+	rl.mu.Lock()
+	now := time.Now()
+	rl.tokens += int64(now.Sub(rl.last)) * rl.rate / int64(time.Second)
+	if rl.tokens > rl.rate {
+		rl.tokens = rl.rate
+	}
+	rl.last = now
+	rl.tokens -= int64(n)
+	var sleep time.Duration
+	if rl.tokens < 0 {
+		sleep = time.Duration(-rl.tokens * int64(time.Second) / rl.rate)
+	}
+	rl.mu.Unlock()
+	if sleep > 0 {
+		time.Sleep(sleep)
+	}
+}
+
+type limitedReader struct {
+	r  io.Reader
+	rl *RateLimiter
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	n, err := lr.r.Read(p)
+	lr.rl.Wait(n)
+	return n, err
+}
+
+// LimitReader 返回按rl限速读取的io.Reader
+func LimitReader(r io.Reader, rl *RateLimiter) io.Reader {
+	if rl == nil || rl.rate <= 0 {
+		return r
+	}
+	return &limitedReader{r: r, rl: rl}
+}
@@ -0,0 +1,84 @@
+package handle
+
+import "strings"
+
+// 浏览器/客户端识别规则，按顺序匹配，靠前的规则优先（如Edge和Chrome的UA中都含有Chrome/）
+var uaBrowsers = []struct {
+	token  string
+	family string
+}{
+	{"edg/", "Edge"},
+	{"edge/", "Edge"},
+	{"opr/", "Opera"},
+	{"opera", "Opera"},
+	{"yabrowser/", "Yandex"},
+	{"ucbrowser/", "UC Browser"},
+	{"samsungbrowser/", "Samsung Internet"},
+	{"micromessenger/", "WeChat"},
+	{"qqbrowser/", "QQ Browser"},
+	{"firefox/", "Firefox"},
+	{"chrome/", "Chrome"},
+	{"crios/", "Chrome"},
+	{"fxios/", "Firefox"},
+	{"msie ", "IE"},
+	{"trident/", "IE"},
+	{"safari/", "Safari"},
+	{"curl/", "curl"},
+	{"wget/", "Wget"},
+	{"okhttp/", "okhttp"},
+	{"python-requests/", "python-requests"},
+	{"go-http-client/", "Go-http-client"},
+	{"java/", "Java"},
+}
+
+var uaOS = []struct {
+	token string
+	os    string
+}{
+	{"windows", "Windows"},
+	{"android", "Android"},
+	{"iphone", "iOS"},
+	{"ipad", "iOS"},
+	{"ipod", "iOS"},
+	{"mac os x", "macOS"},
+	{"macintosh", "macOS"},
+	// "X11; CrOS x86_64 ..."，需带分隔符，避免匹配到microsoft等
+	{"; cros ", "Chrome OS"},
+	{"linux", "Linux"},
+}
+
+var uaBots = []string{"bot", "spider", "crawl", "slurp"}
+
+// ParseUserAgent 粗略解析User-Agent，返回浏览器/客户端、操作系统与设备类型（desktop/mobile/tablet/bot），无法识别的返回Other
+func ParseUserAgent(ua string) (family string, os string, device string) {
+	s := strings.ToLower(ua)
+	family, os, device = "Other", "Other", "desktop"
+	for _, b := range uaBrowsers {
+		if strings.Contains(s, b.token) {
+			family = b.family
+			break
+		}
+	}
+	for _, o := range uaOS {
+		if strings.Contains(s, o.token) {
+			os = o.os
+			break
+		}
+	}
+	switch {
+	case strings.Contains(s, "ipad") || strings.Contains(s, "tablet"):
+		device = "tablet"
+	case strings.Contains(s, "mobile") || strings.Contains(s, "iphone") || os == "Android":
+		device = "mobile"
+	}
+	for _, bot := range uaBots {
+		if strings.Contains(s, bot) {
+			device = "bot"
+			if family == "Other" {
+				family = "Bot"
+			}
+			break
+		}
+	}
+	return
+}
@@ -0,0 +1,33 @@
+package handle
+
+import "testing"
+
+func TestParseUserAgent(t *testing.T) {
+	tests := []struct {
+		ua     string
+		family string
+		os     string
+		device string
+	}{
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36 Edg/120.0.0.0",
+			"Edge", "Windows", "desktop"},
+		{"Mozilla/5.0 (X11; CrOS x86_64 14541.0.0) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36",
+			"Chrome", "Chrome OS", "desktop"},
+		{"Microsoft BITS/7.8", "Other", "Other", "desktop"},
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.0 Mobile/15E148 Safari/604.1",
+			"Safari", "iOS", "mobile"},
+		{"Mozilla/5.0 (iPad; CPU OS 17_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) CriOS/120.0 Mobile/15E148 Safari/604.1",
+			"Chrome", "iOS", "tablet"},
+		{"Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Mobile Safari/537.36",
+			"Chrome", "Android", "mobile"},
+		{"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)", "Bot", "Other", "bot"},
+		{"curl/8.4.0", "curl", "Other", "desktop"},
+		{"", "Other", "Other", "desktop"},
+	}
+	for _, tt := range tests {
+		family, os, device := ParseUserAgent(tt.ua)
+		if family != tt.family || os != tt.os || device != tt.device {
+			t.Errorf("ParseUserAgent(%q) = %s, %s, %s, want %s, %s, %s", tt.ua, family, os, device, tt.family, tt.os, tt.device)
+		}
+	}
+}
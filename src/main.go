@@ -1,13 +1,13 @@
 package main
 
 import (
-	"bufio"
 	"compress/gzip"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
-	"github.com/olivere/elastic"
 	"io"
 	"log"
+	"math"
 	"net/http"
 	"os"
 	"os/exec"
@@ -18,6 +18,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -36,8 +37,84 @@ var ScriptPath string
 var EsHost string
 var EsUser string
 var EsPass string
+var EsApiKey string
+var EsBearerToken string
+var ContextMaxBytes int
+var MaxLineBytes int
 var EsCh = make(chan bool, 5)
-var esClient *elastic.Client
+var ScanWorkers int
+var ScanCh chan bool
+var MaxProcs int
+var Scheduler *taskScheduler
+var ReadLimiter *handle.RateLimiter
+var ResultBuffer *bufferGate
+var ScanNice int
+var MaxTimeoutSeconds int
+var MaxBytesScanned int64
+var MaxAggGroups int
+var MaxAggValues int
+var MaxTopValues int
+var PrivacyExclude []string
+var PrivacyRules []RedactSpec
+
+// PrivacyTypes 配置文件[Privacy.<logType>]中按日志类型与列号配置的排除列与脱敏规则
+var PrivacyTypes = map[string]PrivacyPolicy{}
+var PrivacySalt string
+var GeoIPDb *handle.MMDB
+var AsnDb *handle.MMDB
+var EnrichRules = map[string][]EnrichSpec{}
+var ScanIoClass int
+var ScanIoLevel int
+var IndexPattern string
+var IndexDateLayout string
+var IndexMode string
+var IndexTemplate string
+var IndexAlias string
+var IlmPolicy string
+var IndexRetentionDays int
+var RolloverMaxSize string
+var RolloverMaxAge string
+var MaxResultWindow int
+var esClient *esConn
+var retClient *http.Client
+var Spool *diskSpool
+var RawAllowPaths []string
+var TailMaxSeconds int
+var TailPollInterval time.Duration
+var Tails *tailRegistry
+var Saved *savedStore
+var AlertWebhook string
+
+// RetStruct 检索任务完成后回调RetUrl的内容，任务提前结束时TruncatedReason说明原因，任务被丢弃时DropReason说明原因
+type RetStruct struct {
+	TaskId          string
+	HostName        string
+	DoneTs          int64
+	TotalCount      int
+	FailCount       int32
+	LongCount       int32
+	BytesScanned    int64
+	TruncatedReason string                   `json:",omitempty"`
+	DropReason      string                   `json:",omitempty"`
+	Aggregate       []map[string]interface{} `json:",omitempty"`
+	Summary         map[string]ColSummary    `json:",omitempty"`
+	MatchedCount    int64                    `json:",omitempty"`
+	// 按logHeader声明的类型或富化配置转换失败的值的个数
+	ConvertFailCount int32 `json:",omitempty"`
+	// 按ES节点统计的写入失败次数（包括之后重试成功的失败）
+	EsFailures map[string]int32 `json:",omitempty"`
+	// ES不可用时写入本地spool、等待恢复后重放的文档数
+	SpooledCount int32 `json:",omitempty"`
+	// 定期检索运行时为检索的ID与本次检索的时间范围[WindowStart, WindowEnd)（秒）
+	SavedId     string `json:",omitempty"`
+	WindowStart int64  `json:",omitempty"`
+	WindowEnd   int64  `json:",omitempty"`
+	// 定期检索配置了告警时的判断结果
+	Alert *AlertResult `json:",omitempty"`
+}
+
+// 判断文件尾行时间时，从文件末尾读取的字节数
+const tailReadBytes = 64 * 1024
 
 type RuleStruct struct {
 	Value  string
@@ -45,6 +122,38 @@ type RuleStruct struct {
 	ColNum int
 }
 
+// SearchParam 一次日志检索任务的参数，由runFreeSearch根据请求生成
+type SearchParam struct {
+	StartTime         int64
+	EndTime           int64
+	TaskId            string
+	EsIndex           string
+	Delimiter         string
+	DatePosition      []int
+	DateFormat        handle.DateFormat
+	MaxCount          int
+	SelectRegularList []RuleStruct
+	DeAllInOne        bool
+	LogHeader         []string
+	ColTypes          []string
+	ContextBefore     int
+	ContextAfter      int
+	ScanWorkers       int
+	Deadline          time.Time
+	MaxBytes          int64
+	Aggregate         *aggregator
+	Summary           *summarizer
+	Sample            *sampler
+	Fields            *fieldPolicy
+	Enrich            *enrichment
+	Alert             *alerter
+}
+
+// full 匹配额度已用完，不需要继续检索；带告警时仍需统计整个时间范围
+func (sp *SearchParam) full(st *TaskStats) bool {
+	return sp.Alert == nil && int(atomic.LoadInt32(&st.Count)) >= sp.MaxCount
+}
+
 // 读取配置文件参数，全局变量初始化，连接ES
 func init() {
 	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
@@ -61,21 +170,195 @@ func init() {
 	EsHost = config.MustValue("LogSearch", "esHost")
 	EsUser = config.MustValue("LogSearch", "esUser")
 	EsPass = config.MustValue("LogSearch", "esPass")
+	EsApiKey = config.MustValue("LogSearch", "esApiKey")
+	EsBearerToken = config.MustValue("LogSearch", "esBearerToken")
+	MaxLineBytes, _ = strconv.Atoi(config.MustValue("LogSearch", "maxLineBytes", "1048576"))
+	ContextMaxBytes, _ = strconv.Atoi(config.MustValue("LogSearch", "contextMaxBytes", "8192"))
+	MaxTimeoutSeconds, _ = strconv.Atoi(config.MustValue("LogSearch", "maxTimeoutSeconds", "0"))
+	MaxBytesScanned, _ = strconv.ParseInt(config.MustValue("LogSearch", "maxBytesScanned", "0"), 10, 64)
+	MaxAggGroups, _ = strconv.Atoi(config.MustValue("LogSearch", "maxAggGroups", "10000"))
+	MaxAggValues, _ = strconv.Atoi(config.MustValue("LogSearch", "maxAggValues", "1000000"))
+	check.MaxSampleSize, _ = strconv.Atoi(config.MustValue("LogSearch", "maxSampleSize", "10000"))
+	MaxTopValues, _ = strconv.Atoi(config.MustValue("LogSearch", "maxTopValues", "1000"))
+	TailMaxSeconds, _ = strconv.Atoi(config.MustValue("Tail", "maxSeconds", "3600"))
+	tailMaxTasks, _ := strconv.Atoi(config.MustValue("Tail", "maxTasks", "4"))
+	Tails = newTailRegistry(tailMaxTasks)
+	tailPollMs, _ := strconv.Atoi(config.MustValue("Tail", "pollMs", "1000"))
+	if tailPollMs < 100 {
+		tailPollMs = 100
+	}
+	TailPollInterval = time.Duration(tailPollMs) * time.Millisecond
+	if paths := config.MustValue("LogSearch", "rawAllowPaths"); paths != "" {
+		RawAllowPaths = strings.Split(paths, ",")
+	}
+	PrivacySalt = config.MustValue("Privacy", "hashSalt")
+	privacy, err := loadPrivacy(config, "Privacy", false)
+	if err != nil {
+		log.Fatalf("[Privacy]配置错误：%s", err)
+	}
+	PrivacyExclude, PrivacyRules = privacy.Exclude, privacy.Rules
+	check.PrivacyCols[""] = privacy.cols()
+	for _, section := range config.GetSectionList() {
+		logType := strings.TrimPrefix(section, "Privacy.")
+		if logType == section {
+			continue
+		}
+		if PrivacyTypes[logType], err = loadPrivacy(config, section, true); err != nil {
+			log.Fatalf("[%s]配置错误：%s", section, err)
+		}
+		check.PrivacyCols[logType] = PrivacyTypes[logType].cols()
+	}
+	if path := config.MustValue("Enrich", "geoipDb"); path != "" {
+		if GeoIPDb, err = handle.OpenMMDB(path); err != nil {
+			log.Fatalf("无法加载GeoIP数据库%s：%s", path, err)
+		}
+	}
+	if path := config.MustValue("Enrich", "asnDb"); path != "" {
+		if AsnDb, err = handle.OpenMMDB(path); err != nil {
+			log.Fatalf("无法加载ASN数据库%s：%s", path, err)
+		}
+	}
+	for _, key := range config.GetKeyList("Enrich") {
+		if key == "geoipDb" || key == "asnDb" {
+			continue
+		}
+		specs, err := parseEnrichSpecs(config.MustValue("Enrich", key))
+		if err != nil {
+			log.Fatalf("日志类型%s的富化配置错误：%s", key, err)
+		}
+		EnrichRules[key] = specs
+	}
+	ScanWorkers, _ = strconv.Atoi(config.MustValue("LogSearch", "scanWorkers", "1"))
+	globalScanWorkers, _ := strconv.Atoi(config.MustValue("LogSearch", "globalScanWorkers", "1"))
+	if globalScanWorkers < 1 {
+		globalScanWorkers = 1
+	}
+	ScanCh = make(chan bool, globalScanWorkers)
+	MaxProcs, _ = strconv.Atoi(config.MustValue("All", "maxProcs", "1"))
+	maxTasks, _ := strconv.Atoi(config.MustValue("Governor", "maxTasks", "2"))
+	maxQueue, _ := strconv.Atoi(config.MustValue("Governor", "maxQueue", "20"))
+	maxQueueSeconds, _ := strconv.Atoi(config.MustValue("Governor", "maxQueueSeconds", "600"))
+	Scheduler = newTaskScheduler(maxTasks, maxQueue, time.Duration(maxQueueSeconds)*time.Second)
+	readMBps, _ := strconv.ParseFloat(config.MustValue("Governor", "readMBps", "0"), 64)
+	ReadLimiter = handle.NewRateLimiter(int64(readMBps * 1024 * 1024))
+	maxBufferMB, _ := strconv.Atoi(config.MustValue("Governor", "maxBufferMB", "64"))
+	ResultBuffer = newBufferGate(int64(maxBufferMB) * 1024 * 1024)
+	ScanNice, _ = strconv.Atoi(config.MustValue("Governor", "scanNice", "0"))
+	ScanIoClass, _ = strconv.Atoi(config.MustValue("Governor", "scanIoClass", "0"))
+	ScanIoLevel, _ = strconv.Atoi(config.MustValue("Governor", "scanIoLevel", "4"))
+	IndexPattern = config.MustValue("Index", "namePattern", "log_search_{logType}_{date}")
+	IndexDateLayout = config.MustValue("Index", "dateLayout", "20060102")
+	IndexMode = config.MustValue("Index", "mode", IndexModeIndex)
+	if IndexMode != IndexModeIndex && IndexMode != IndexModeDataStream {
+		log.Fatalf("索引写入方式mode配置错误：%s", IndexMode)
+	}
+	IndexTemplate = config.MustValue("Index", "template")
+	if IndexMode == IndexModeDataStream && IndexTemplate == "" {
+		log.Fatalf("数据流模式需要配置索引模板template")
+	}
+	IndexAlias = config.MustValue("Index", "alias")
+	IlmPolicy = config.MustValue("Index", "ilmPolicy")
+	IndexRetentionDays, _ = strconv.Atoi(config.MustValue("Index", "retentionDays", "0"))
+	RolloverMaxSize = config.MustValue("Index", "rolloverMaxSize", "50gb")
+	RolloverMaxAge = config.MustValue("Index", "rolloverMaxAge", "1d")
+	MaxResultWindow, _ = strconv.Atoi(config.MustValue("Index", "maxResultWindow", "10000"))
 
-	esClient, err = elastic.NewClient(elastic.SetURL(EsHost), elastic.SetBasicAuth(EsUser, EsPass), elastic.SetSniff(false))
+	esTimeoutSeconds, _ := strconv.Atoi(config.MustValue("LogSearch", "esTimeoutSeconds", "30"))
+	esTLS, err := loadTLSConfig(config, "EsTLS")
 	if err != nil {
-		panic(err)
+		log.Fatalf("ES连接的TLS配置错误：%s", err)
 	}
-	info, code, err := esClient.Ping(EsHost).Do(context.Background())
+	retTLS, err := loadTLSConfig(config, "RetTLS")
 	if err != nil {
+		log.Fatalf("retUrl回调的TLS配置错误：%s", err)
+	}
+	retClient = newHttpClient(60*time.Second, retTLS)
+	esMaxRetries, _ := strconv.Atoi(config.MustValue("LogSearch", "esMaxRetries", "3"))
+	esBackoffMs, _ := strconv.Atoi(config.MustValue("LogSearch", "esBackoffMs", "500"))
+	esHealthSeconds, _ := strconv.Atoi(config.MustValue("LogSearch", "esHealthCheckSeconds", "10"))
+	esClient = newEsConn(EsHost, esAuthHeader(EsApiKey, EsBearerToken, EsUser, EsPass), time.Duration(esTimeoutSeconds)*time.Second, esTLS,
+		esMaxRetries, time.Duration(esBackoffMs)*time.Millisecond)
+	if err = esClient.Ping(); err != nil {
 		panic(err)
 	}
-	log.Printf("Es return with code %d and version %s \n", code, info.Version.Number)
+	log.Printf("Es return with %s version %s \n", esClient.Flavor, esClient.Number)
+	if esHealthSeconds > 0 {
+		go esClient.healthCheck(time.Duration(esHealthSeconds) * time.Second)
+	}
+	spoolMB, _ := strconv.ParseInt(config.MustValue("Spool", "maxMB", "1024"), 10, 64)
+	spoolTtlHours, _ := strconv.Atoi(config.MustValue("Spool", "ttlHours", "24"))
+	Spool, err = openDiskSpool(config.MustValue("Spool", "dir"), spoolMB*1024*1024, time.Duration(spoolTtlHours)*time.Hour)
+	if err != nil {
+		log.Fatalf("无法打开spool目录：%s", err)
+	}
+	if Spool != nil {
+		replaySeconds, _ := strconv.Atoi(config.MustValue("Spool", "replaySeconds", "30"))
+		if replaySeconds < 1 {
+			replaySeconds = 1
+		}
+		go Spool.run(time.Duration(replaySeconds) * time.Second)
+	}
+	AlertWebhook = config.MustValue("Alert", "webhook")
+	savedMax, _ := strconv.Atoi(config.MustValue("Saved", "maxSearches", "100"))
+	savedLag, _ := strconv.Atoi(config.MustValue("Saved", "lagSeconds", "30"))
+	Saved, err = openSavedStore(config.MustValue("Saved", "dir"), savedMax, time.Duration(savedLag)*time.Second)
+	if err != nil {
+		log.Fatalf("无法打开定期检索目录：%s", err)
+	}
+	if Saved != nil {
+		go Saved.run()
+	}
+	// 安装失败时在检索任务创建索引前重试
+	if err = Indices.install(); err != nil {
+		log.Println("索引模板安装失败：", err)
+	}
+}
+
+// 读取配置文件中一个TLS配置节，未配置时返回nil
+func loadTLSConfig(config *goconfig.ConfigFile, section string) (*tls.Config, error) {
+	return handle.NewTLSConfig(
+		config.MustValue(section, "caFile"),
+		config.MustValue(section, "certFile"),
+		config.MustValue(section, "keyFile"),
+		config.MustValue(section, "serverName"),
+		config.MustValue(section, "minVersion"),
+	)
+}
+
+// 读取配置文件中一个脱敏配置节：exclude为排除列，键名以rule开头的为脱敏规则；byNumber为true时列只能是从1开始的列号或*
+func loadPrivacy(config *goconfig.ConfigFile, section string, byNumber bool) (PrivacyPolicy, error) {
+	var policy PrivacyPolicy
+	if exclude := config.MustValue(section, "exclude"); exclude != "" {
+		policy.Exclude = strings.Split(exclude, ",")
+	}
+	cols := policy.Exclude
+	for _, key := range config.GetKeyList(section) {
+		if !strings.HasPrefix(key, "rule") {
+			continue
+		}
+		spec, err := parseRedactSpec(config.MustValue(section, key))
+		if err != nil {
+			return policy, fmt.Errorf("%s: %s", key, err)
+		}
+		policy.Rules = append(policy.Rules, spec)
+		cols = append(cols, spec.Cols...)
+	}
+	if byNumber {
+		for _, c := range cols {
+			if n, err := strconv.Atoi(strings.TrimSpace(c)); strings.TrimSpace(c) != "*" && (err != nil || n < 1) {
+				return policy, fmt.Errorf("column %s must be a column number starting from 1 or *", c)
+			}
+		}
+	}
+	return policy, nil
 }
 
 // 调用GinHttps函数，启动HTTPS server
 func main() {
-	runtime.GOMAXPROCS(1)
+	// maxProcs为0时使用全部CPU核心
+	if MaxProcs > 0 {
+		runtime.GOMAXPROCS(MaxProcs)
+	}
 	err := GinHttps(true)
 	if err != nil {
 		return
@@ -112,7 +395,8 @@ func getGzFile(gzDict map[string][2]int64, startTime int64, endTime int64) []str
 }
 
 // 判断这个文件的[首行/尾行]时间是否符合条件
-func isTimeOk(strList []string, ts int64, datePosition []int, dateFormat string, _type bool) (int64, bool) {
+func isTimeOk(strList []string, ts int64, datePosition []int, dateFormat handle.DateFormat, anchor handle.YearAnchor,
+	_type bool) (int64, bool) {
 	defer func() {
 		if err := recover(); err != nil {
 		}
@@ -126,23 +410,32 @@ func isTimeOk(strList []string, ts int64, datePosition []int, dateFormat string,
 	} else {
 		dateStr = strList[datePosition[0]] + " " + strList[datePosition[1]] + " " + strList[datePosition[2]]
 	}
-	stamp, _ := time.ParseInLocation(dateFormat, dateStr, time.Local)
+	stamp, _ := dateFormat.Parse(dateStr)
 
-	uTs := handle.FillYear(stamp)
+	uTs := handle.FillYear(stamp, anchor)
 	if _type {
 		// 文件头的时间与查询结束时间比较，符合时返回 文件头的时间戳、true
-		if uTs < ts+1 {
+		if uTs <= ts {
 			return uTs, true
 		}
 	} else {
 		// 文件尾的时间与查询开始时间比较，符合时返回 文件尾的时间戳、true
-		if uTs > ts-1 {
+		if uTs >= ts {
 			return uTs, true
 		}
 	}
 	return 0, false
 }
 
+// 用检索时间窗口和文件修改时间生成补全年份的参考
+func fileYearAnchor(file *os.File, startTime int64, endTime int64) handle.YearAnchor {
+	anchor := handle.YearAnchor{Start: startTime, End: endTime}
+	if fi, err := file.Stat(); err == nil {
+		anchor.ModTime = fi.ModTime()
+	}
+	return anchor
+}
+
 // 把文件一行的字符串按指定分割规则，转成切片类型
 func strSplit(line string, delimiter string, deAllInOne bool) []string {
 	strList := strings.Split(line, delimiter)
@@ -159,144 +452,143 @@ func strSplit(line string, delimiter string, deAllInOne bool) []string {
 	return strListNew
 }
 
+// 读取文件开头的两行，用于判断文件首行时间
+func headLines(r io.Reader) []string {
+	lr := handle.NewLineReader(r, MaxLineBytes)
+	var lineList []string
+	for i := 0; i < 2; i++ {
+		line, _, err := lr.ReadLine()
+		if err != nil {
+			break
+		}
+		lineList = append(lineList, line)
+	}
+	return lineList
+}
+
+// 读取文件末尾（最多tailReadBytes字节）中完整的最后两行，用于判断文件尾行时间
+func tailLines(file *os.File) []string {
+	fi, err := file.Stat()
+	if err != nil {
+		return nil
+	}
+	offset := fi.Size() - tailReadBytes
+	if offset < 0 {
+		offset = 0
+	}
+	buf := make([]byte, fi.Size()-offset)
+	n, err := file.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		return nil
+	}
+	lineList := strings.Split(strings.TrimRight(string(buf[:n]), "\r\n"), "\n")
+	if offset > 0 {
+		// 第一段可能是不完整的行
+		lineList = lineList[1:]
+	}
+	if len(lineList) > 2 {
+		lineList = lineList[len(lineList)-2:]
+	}
+	return lineList
+}
+
 // 筛选文件，把压缩文件分离出，对非压缩文件进行处理，符合条件的行上传ES
-func doFile(fileName string, startTime int64, endTime int64, taskId string, esIndex string, delimiter string,
-	datePosition []int, dateFormat string, maxCount int, selectRegularList []RuleStruct, deAllInOne bool,
-	logHeader []string, count *int, failCount *int32, gzDict *map[string]int64) {
+// 返回值为可能符合条件的压缩文件的首行时间戳及true，其余情况返回false
+func doFile(fileName string, sp *SearchParam, st *TaskStats) (int64, bool) {
 	file, err := os.Open(fileName)
 	if err != nil {
-		return
+		return 0, false
 	}
 	defer func(file *os.File) {
 		err := file.Close()
 		if err != nil {
 		}
 	}(file)
-	buf := make([]byte, 4096)
+	anchor := fileYearAnchor(file, sp.StartTime, sp.EndTime)
 	if strings.HasSuffix(fileName, ".gz") {
-		gr, err := gzip.NewReader(file)
+		gr, err := gzip.NewReader(handle.LimitReader(file, ReadLimiter))
 		if err != nil {
-			return
+			return 0, false
 		}
 		if strings.HasSuffix(fileName, ".tar.gz") {
 			buf := make([]byte, 512)
 			_, err = gr.Read(buf)
 			if err != nil {
-				return
+				return 0, false
 			}
 		}
-		n, err := gr.Read(buf)
-		if err != nil && err != io.EOF {
-			return
+		lineList := headLines(gr)
+		if len(lineList) == 0 {
+			return 0, false
 		}
-		lineList := strings.Split(string(buf[:n]), "\n")
-		line1 := lineList[0]
-		strList := strSplit(line1, delimiter, deAllInOne)
-		ts, ok := isTimeOk(strList, endTime, datePosition, dateFormat, true)
+		strList := strSplit(lineList[0], sp.Delimiter, sp.DeAllInOne)
+		ts, ok := isTimeOk(strList, sp.EndTime, sp.DatePosition, sp.DateFormat, anchor, true)
 		if !ok {
 			if len(lineList) > 1 {
-				line2 := lineList[1]
-				strList := strSplit(line2, delimiter, deAllInOne)
-				ts, ok = isTimeOk(strList, endTime, datePosition, dateFormat, true)
+				strList := strSplit(lineList[1], sp.Delimiter, sp.DeAllInOne)
+				ts, ok = isTimeOk(strList, sp.EndTime, sp.DatePosition, sp.DateFormat, anchor, true)
 				if !ok {
-					return
+					return 0, false
 				}
 			} else {
-				return
+				return 0, false
 			}
 		}
 		err = gr.Close()
 		if err != nil {
 			panic(err)
 		}
-		(*gzDict)[fileName] = ts
+		return ts, true
 	} else {
 		// 非压缩文件
-		n, err := file.Read(buf)
-		if err != nil && err != io.EOF {
-			return
+		lineList := headLines(handle.LimitReader(file, ReadLimiter))
+		if len(lineList) == 0 {
+			return 0, false
 		}
-		lineList := strings.Split(string(buf[:n]), "\n")
-		line1 := lineList[0]
-		strList := strSplit(line1, delimiter, deAllInOne)
-		_, ok := isTimeOk(strList, endTime, datePosition, dateFormat, true)
+		strList := strSplit(lineList[0], sp.Delimiter, sp.DeAllInOne)
+		_, ok := isTimeOk(strList, sp.EndTime, sp.DatePosition, sp.DateFormat, anchor, true)
 		if !ok {
 			if len(lineList) > 1 {
-				line2 := lineList[1]
-				strList := strSplit(line2, delimiter, deAllInOne)
-				isTimeOk(strList, endTime, datePosition, dateFormat, true)
+				strList := strSplit(lineList[1], sp.Delimiter, sp.DeAllInOne)
+				_, ok = isTimeOk(strList, sp.EndTime, sp.DatePosition, sp.DateFormat, anchor, true)
 				if !ok {
-					return
+					return 0, false
 				}
 			} else {
-				return
+				return 0, false
 			}
 		}
 
-		_, err = file.Seek(-4096, 2)
-		if err == nil {
-			n, err = file.Read(buf)
-			if err != nil && err != io.EOF {
-				return
-			}
-			lineList = strings.Split(string(buf[:n]), "\n")
-		} else {
-			log.Println(err)
-		}
-
-		line1 = lineList[len(lineList)-1]
-		strList = strSplit(line1, delimiter, deAllInOne)
-		_, ok = isTimeOk(strList, startTime, datePosition, dateFormat, false)
-		if !ok {
-			if len(lineList) > 1 {
-				line2 := lineList[len(lineList)-2]
-				strList = strSplit(line2, delimiter, deAllInOne)
-				_, ok = isTimeOk(strList, startTime, datePosition, dateFormat, false)
-				if !ok {
-					return
+		// 文件末尾的行过长无法读取完整时，不按尾行时间排除该文件
+		lineList = tailLines(file)
+		if len(lineList) > 0 {
+			strList = strSplit(lineList[len(lineList)-1], sp.Delimiter, sp.DeAllInOne)
+			_, ok = isTimeOk(strList, sp.StartTime, sp.DatePosition, sp.DateFormat, anchor, false)
+			if !ok {
+				if len(lineList) > 1 {
+					strList = strSplit(lineList[len(lineList)-2], sp.Delimiter, sp.DeAllInOne)
+					_, ok = isTimeOk(strList, sp.StartTime, sp.DatePosition, sp.DateFormat, anchor, false)
+					if !ok {
+						return 0, false
+					}
+				} else {
+					return 0, false
 				}
-			} else {
-				return
 			}
 		}
 		_, err = file.Seek(0, 0)
 		if err != nil {
-			return
+			return 0, false
 		}
 		log.Println(file)
-		fr := bufio.NewReader(file)
-		cacheString := ""
-		for {
-			n, err := fr.Read(buf)
-			if err != nil && err != io.EOF {
-				return
-			}
-			if n == 0 {
-				break
-			}
-			lineList := strings.Split(string(buf[:n]), "\n")
-			lineList[0] = cacheString + lineList[0]
-			cacheString = lineList[len(lineList)-1]
-			if len(cacheString) > 4096 {
-				cacheString = cacheString[:4096] + "......"
-			}
-			for _, line := range lineList {
-				strList := strSplit(line, delimiter, deAllInOne)
-				logTs, ok := isTimeTrueLog(strList, startTime, endTime, datePosition, dateFormat)
-				if ok && isTrueLog(strList, selectRegularList) {
-					go inputES(strList, taskId, esIndex, logHeader, logTs, delimiter, failCount)
-					*count += 1
-					if *count > maxCount {
-						return
-					}
-				}
-			}
-		}
+		scanLines(handle.LimitReader(file, ReadLimiter), sp, anchor, st, logSource{Path: fileName, Id: handle.FileId(file)})
 	}
+	return 0, false
 }
 
 // 判断这条日志的时间是否符合条件
-func isTimeTrueLog(strList []string, sTs int64, eTs int64, datePosition []int, dateFormat string) (int64, bool) {
+func isTimeTrueLog(strList []string, sTs int64, eTs int64, datePosition []int, dateFormat handle.DateFormat,
+	anchor handle.YearAnchor) (int64, bool) {
 	defer func() {
 		if err := recover(); err != nil {
 		}
@@ -310,9 +602,9 @@ func isTimeTrueLog(strList []string, sTs int64, eTs int64, datePosition []int, d
 	} else {
 		dateStr = strList[datePosition[0]] + " " + strList[datePosition[1]] + " " + strList[datePosition[2]]
 	}
-	stamp, _ := time.ParseInLocation(dateFormat, dateStr, time.Local)
+	stamp, _ := dateFormat.Parse(dateStr)
 
-	ts := handle.FillYear(stamp)
+	ts := handle.FillYear(stamp, anchor)
 	if sTs <= ts && ts <= eTs {
 		return ts, true
 	} else {
@@ -384,80 +676,249 @@ func isTrueLog(line []string, rules []RuleStruct) bool {
 	return true
 }
 
+// 脱敏上下文并生成其余的富化字段（geoip与ua字段在脱敏前已生成）
+func prepareRecord(rec *LogRecord, sp *SearchParam, st *TaskStats) {
+	for i, line := range rec.Before {
+		rec.Before[i] = sp.Fields.redactLine(line, sp)
+	}
+	for i, line := range rec.After {
+		rec.After[i] = sp.Fields.redactLine(line, sp)
+	}
+	var failed int32
+	rec.Fields, failed = sp.Enrich.apply(rec.StrList, rec.Fields)
+	if failed > 0 {
+		atomic.AddInt32(&st.ConvertFailCount, failed)
+	}
+}
+
+// 占用结果缓冲内存后异步上传，缓冲已满时阻塞扫描
+func uploadRecord(rec *LogRecord, sp *SearchParam, st *TaskStats) {
+	prepareRecord(rec, sp, st)
+	size := rec.size()
+	ResultBuffer.acquire(size)
+	st.uploads.Add(1)
+	go func() {
+		defer st.uploads.Done()
+		defer ResultBuffer.release(size)
+		inputES(rec, sp, st)
+	}()
+}
+
 // 上传数据到ES，通过channel限制最多并发5个协程
-func inputES(strList []string, taskId string, esIndex string, logHeader []string, ts int64, delimiter string, failCount *int32) {
-	strDict := map[string]string{}
-	strDict["_time"] = strconv.FormatInt(ts, 10)
+func inputES(rec *LogRecord, sp *SearchParam, st *TaskStats) {
+	strDict := recordDoc(rec, sp, st)
+	EsCh <- true
+	defer func() {
+		<-EsCh
+	}()
+	id := docId(check.HostName, rec.FileId, strconv.FormatInt(rec.Offset, 10), sp.TaskId)
+	if err := indexDoc(sp, id, strDict, st); err != nil {
+		atomic.AddInt32(&st.FailCount, 1)
+	}
+}
+
+// 把一条日志转换为写入ES（或实时跟踪推送给客户端）的文档
+func recordDoc(rec *LogRecord, sp *SearchParam, st *TaskStats) map[string]interface{} {
+	strDict := map[string]interface{}{}
+	strDict["_time"] = time.Unix(0, rec.Ts).Format(time.RFC3339Nano)
 	strDict["_hostname"] = check.HostName
-	strDict["0,taskId"] = taskId
-	strDict["&,undefined"] = ""
-	logHeaderLen := len(logHeader)
-	for i, str := range strList {
+	strDict["0,taskId"] = sp.TaskId
+	strDict["_file"] = rec.File
+	strDict["_offset"] = rec.Offset
+	// 实时跟踪从文件末尾开始读取，没有行号
+	if rec.LineNo > 0 {
+		strDict["_line"] = rec.LineNo
+	}
+	strDict["_rotatedArchive"] = rec.Archive
+	undefined := ""
+	logHeaderLen := len(sp.LogHeader)
+	for i, str := range rec.StrList {
+		if !sp.Fields.keep(i) {
+			continue
+		}
 		if i < logHeaderLen {
-			strDict[logHeader[i]] = str
+			v, ok := handle.CoerceValue(sp.ColTypes[i], str, sp.DateFormat)
+			if !ok {
+				atomic.AddInt32(&st.ConvertFailCount, 1)
+				strDict[sp.LogHeader[i]+"_raw"] = str
+			}
+			strDict[sp.LogHeader[i]] = v
 		} else {
-			strDict["&,undefined"] += str + delimiter
+			undefined += str + sp.Delimiter
 			// strDict[strconv.Itoa(i+1)] = str
 		}
 	}
-	strDict["&,undefined"] = strings.TrimRight(strDict["&,undefined"], delimiter)
-	marshal, _ := json.Marshal(strDict)
+	strDict["&,undefined"] = strings.TrimRight(undefined, sp.Delimiter)
+	for k, v := range rec.Fields {
+		// 未输出的列不生成空的类型转换结果
+		if _, ok := strDict[k]; !ok && v == nil {
+			continue
+		}
+		strDict[k] = v
+	}
+	if rec.Truncated {
+		strDict["_truncated"] = "true"
+	}
+	if len(rec.Before) > 0 {
+		strDict["_contextBefore"] = strings.Join(rec.Before, "\n")
+	}
+	if len(rec.After) > 0 {
+		strDict["_contextAfter"] = strings.Join(rec.After, "\n")
+	}
+	return strDict
+}
+
+// 上传一行聚合结果到ES，通过EsCh限制并发
+func inputESRow(i int, row map[string]interface{}, sp *SearchParam, st *TaskStats) {
+	row["_hostname"] = check.HostName
+	row["0,taskId"] = sp.TaskId
+	row["_aggregate"] = "true"
 	EsCh <- true
 	defer func() {
 		<-EsCh
 	}()
-	_, err := esClient.Index().Index(esIndex).Type("_doc").BodyString(string(marshal)).Do(context.Background())
-	if err != nil {
-		atomic.AddInt32(failCount, 1)
+	// 聚合结果按分组与时间桶排序，相同任务的第i行对应同一个分组
+	id := docId(check.HostName, "_aggregate", strconv.Itoa(i), sp.TaskId)
+	if err := indexDoc(sp, id, row, st); err != nil {
+		atomic.AddInt32(&st.FailCount, 1)
 	}
 }
 
-// 顺序读取与解压gz压缩文件，缓存区4kb（过长的行会被截断），把符合条件的行上传到ES
-func doGzFile(fileName string, startTime int64, endTime int64, taskId string, esIndex string, delimiter string,
-	datePosition []int, dateFormat string, maxCount int, selectRegularList []RuleStruct, deAllInOne bool,
-	logHeader []string, count *int, failCount *int32) {
+// 顺序读取与解压gz压缩文件，把符合条件的行上传到ES
+func doGzFile(fileName string, sp *SearchParam, st *TaskStats) {
 	file, _ := os.Open(fileName)
 	defer func(file *os.File) {
 		err := file.Close()
 		if err != nil {
 		}
 	}(file)
-	gr, err := gzip.NewReader(file)
+	anchor := fileYearAnchor(file, sp.StartTime, sp.EndTime)
+	gr, err := gzip.NewReader(handle.LimitReader(file, ReadLimiter))
+	if err != nil {
+		return
+	}
+	scanLines(gr, sp, anchor, st, logSource{Path: fileName, Id: handle.FileId(file), Archive: true})
+	err = gr.Close()
 	if err != nil {
 		return
 	}
-	buf := make([]byte, 4096)
-	cacheString := ""
+}
+
+// logSource 正在检索的日志文件，Archive表示轮转后的压缩文件
+type logSource struct {
+	Path    string
+	Id      string
+	Archive bool
+}
+
+// 按行顺序读取文件内容，把符合条件的行及其上下文上传到ES；超过MaxLineBytes的行会被截断并计数
+func scanLines(r io.Reader, sp *SearchParam, anchor handle.YearAnchor, st *TaskStats, src logSource) {
+	lc := newLineContext(sp.ContextBefore, sp.ContextAfter, ContextMaxBytes)
+	defer func() {
+		for _, rec := range lc.flush() {
+			if !rec.held {
+				uploadRecord(rec, sp, st)
+			}
+		}
+	}()
+	lr := handle.NewLineReader(r, MaxLineBytes)
 	for {
-		n, err := gr.Read(buf)
-		if err != nil && err != io.EOF {
+		line, truncated, err := lr.ReadLine()
+		if err != nil {
+			if err != io.EOF {
+				log.Println(err)
+			}
 			return
 		}
-		if n == 0 {
-			break
+		if truncated {
+			atomic.AddInt32(&st.LongCount, 1)
+		}
+		if st.scanned(sp, len(line)+1) {
+			return
 		}
-		lineList := strings.Split(string(buf[:n]), "\n")
-		lineList[0] = cacheString + lineList[0]
-		cacheString = lineList[len(lineList)-1]
-		if len(cacheString) > 4096 {
-			cacheString = cacheString[:4096] + "......"
-		}
-		for _, line := range lineList {
-			strList := strSplit(line, delimiter, deAllInOne)
-			logTs, ok := isTimeTrueLog(strList, startTime, endTime, datePosition, dateFormat)
-			if ok && isTrueLog(strList, selectRegularList) {
-				go inputES(strList, taskId, esIndex, logHeader, logTs, delimiter, failCount)
-				*count += 1
-				if *count > maxCount {
+		strList := strSplit(line, sp.Delimiter, sp.DeAllInOne)
+		var rec *LogRecord
+		logTs, ok := isTimeTrueLog(strList, sp.StartTime, sp.EndTime, sp.DatePosition, sp.DateFormat, anchor)
+		if ok && isTrueLog(strList, sp.SelectRegularList) {
+			sp.Alert.observe(strList, line, sp)
+			raw := strList
+			strList = sp.Fields.redact(strList)
+			if sp.Aggregate != nil || sp.Summary != nil {
+				// 聚合与汇总模式只做统计，不上传日志，也不受maxCount限制
+				atomic.AddInt32(&st.Count, 1)
+				if sp.Aggregate != nil {
+					sp.Aggregate.add(strList, logTs)
+				}
+				if sp.Summary != nil {
+					sp.Summary.add(strList)
+				}
+				continue
+			}
+			rec = &LogRecord{StrList: strList, Ts: logTs, File: src.Path, FileId: src.Id, Archive: src.Archive,
+				Offset: lr.Offset, LineNo: lr.LineNo, Truncated: truncated}
+			pick := sampleUpload
+			if sp.Sample != nil || sp.Alert != nil {
+				atomic.AddInt64(&st.Matched, 1)
+			}
+			if sp.Sample != nil {
+				pick = sp.Sample.pick(rec)
+			}
+			switch pick {
+			case sampleSkip:
+				rec = nil
+			case sampleUpload:
+				if sp.Alert != nil {
+					// 告警需要统计整个时间范围：超出maxCount的日志不上传，继续扫描
+					if !st.tryCount(sp.MaxCount) {
+						rec = nil
+					}
+				} else if !st.takeCount(sp.MaxCount) {
 					return
 				}
+			case sampleHold:
+				// 蓄水池中的日志照常收集上下文，任务结束后统一上传
+				rec.held = true
+			}
+			if rec != nil {
+				rec.Fields = sp.Enrich.derive(raw)
+			}
+		}
+		for _, done := range lc.add(line, rec) {
+			if !done.held {
+				uploadRecord(done, sp, st)
 			}
 		}
+		// 其他文件的检索已用完匹配额度
+		if sp.full(st) && len(lc.pending) == 0 {
+			return
+		}
 	}
-	err = gr.Close()
-	if err != nil {
-		return
+}
+
+// 用最多workers个协程并发处理文件列表，同时受全局扫描并发数ScanCh限制；每个文件由一个协程按顺序读取
+func scanFiles(fileList []string, workers int, fn func(fileName string)) {
+	if workers < 1 {
+		workers = 1
 	}
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < workers && i < len(fileList); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			lowerScanPriority()
+			for fileName := range jobs {
+				ScanCh <- true
+				fn(fileName)
+				<-ScanCh
+			}
+		}()
+	}
+	for _, fileName := range fileList {
+		jobs <- fileName
+	}
+	close(jobs)
+	wg.Wait()
 }
 
 // 按文件内容的时间顺序排序
@@ -480,16 +941,15 @@ func sortFiles(gzDict map[string]int64) map[string][2]int64 {
 			nextTs = tmpList[i+1]
 			retDict[tmpDict[ts]] = [2]int64{ts, nextTs}
 		} else {
-			retDict[tmpDict[ts]] = [2]int64{ts, 9000000000}
+			retDict[tmpDict[ts]] = [2]int64{ts, math.MaxInt64}
 		}
 	}
 	return retDict
 }
 
-// 日志检索，参数获取与初始化、doFile和doGzFile分别用来打开未压缩文件和压缩文件对文件内容做详细筛选
-func runFreeSearch(data map[string]interface{}, fileList []string) {
-	startTime := int64(data["startTime"].(float64))
-	endTime := int64(data["endTime"].(float64))
+// 根据请求生成检索与实时跟踪共用的参数：过滤规则、列名与类型、日期格式、匹配条数上限、字段与富化规则，
+// selectRegular格式错误时返回nil
+func newSearchParam(data map[string]interface{}) *SearchParam {
 	taskId := fmt.Sprint(data["taskId"])
 	logType := fmt.Sprint(data["logType"])
 	delimiter := fmt.Sprint(data["delimiter"])
@@ -506,7 +966,7 @@ func runFreeSearch(data map[string]interface{}, fileList []string) {
 			arr, _ := json.Marshal(vMap)
 			err := json.Unmarshal(arr, &ru)
 			if err != nil {
-				return
+				return nil
 			}
 			selectRegularList = append(selectRegularList, ru)
 		}
@@ -514,19 +974,25 @@ func runFreeSearch(data map[string]interface{}, fileList []string) {
 
 	logHeader, ok := data["logHeader"]
 	var logHeaderList []string
+	var colTypes []string
 	if ok {
 		tmpList, _ := logHeader.([]interface{})
 		for _, v := range tmpList {
-			logHeaderList = append(logHeaderList, fmt.Sprint(v))
+			// 列可以声明类型，如"rt:double"，用于生成索引映射与上传时的类型转换
+			name, typ := handle.SplitColType(fmt.Sprint(v))
+			logHeaderList = append(logHeaderList, name)
+			colTypes = append(colTypes, typ)
 		}
 	}
 
 	var datePositionRet []int
-	for _, v := range datePositionList {
-		vi, _ := strconv.Atoi(v)
-		datePositionRet = append(datePositionRet, vi-1)
+	if _, ok := data["datePosition"]; ok {
+		for _, v := range datePositionList {
+			vi, _ := strconv.Atoi(v)
+			datePositionRet = append(datePositionRet, vi-1)
+		}
 	}
-	dateFormat := fmt.Sprint(data["dateFormat"])
+	dateFormat, _ := handle.NewDateFormat(fmt.Sprint(data["dateFormat"]))
 	var maxCount int
 	_, ok = data["maxCount"]
 	if ok {
@@ -541,72 +1007,175 @@ func runFreeSearch(data map[string]interface{}, fileList []string) {
 	} else {
 		deAllInOne = false
 	}
-	esIndex := "log_search_" + logType + "_" + time.Unix(time.Now().Unix(), 0).Format("20060102")
-	exist, _ := esClient.IndexExists(esIndex).Do(context.Background())
-	if !exist {
-		headerMap := map[string]map[string]string{}
-		headerMap["_time"] = map[string]string{"type": "date", "format": "epoch_second"}
-		headerMap["_hostname"] = map[string]string{"type": "keyword"}
-		headerMap["0,taskId"] = map[string]string{"type": "keyword"}
-		headerMap["*"] = map[string]string{"type": "keyword"}
-		for _, v := range logHeaderList {
-			headerMap[v] = map[string]string{"type": "keyword"}
-		}
-		marshal, _ := json.Marshal(headerMap)
-		// 将不确定的字段通过动态模板方式都定义类型为keyword，防止日期型的字段被ES自动  定义为date类型
-		mapping := `{"settings": {"index": {"max_result_window": "1000000000"}}, "mappings": { "dynamic_templates": [
-{"string_fields": {"match": "*", "match_mapping_type": "string", "mapping": {"type": "keyword"}}},
-{"date_fields": {"match": "*", "match_mapping_type": "date", "mapping": {"type": "keyword"}}}], "properties": **}}`
-		mapping = strings.Replace(mapping, "**", string(marshal), 1)
-		createIndex, err := esClient.CreateIndex(esIndex).BodyString(mapping).Do(context.Background())
-		if err != nil {
-			log.Println(err)
-		} else {
-			if !createIndex.Acknowledged {
-				log.Println("es索引创建失败")
-			}
+	sp := &SearchParam{
+		TaskId:            taskId,
+		Delimiter:         delimiter,
+		DatePosition:      datePositionRet,
+		DateFormat:        dateFormat,
+		MaxCount:          maxCount,
+		SelectRegularList: selectRegularList,
+		DeAllInOne:        deAllInOne,
+		LogHeader:         logHeaderList,
+		ColTypes:          colTypes,
+	}
+	sp.Fields = newFieldPolicy(data, logHeaderList)
+	sp.Enrich = newEnrichment(logType, logHeaderList)
+	return sp
+}
+
+// 按日志类型生成结果索引名，确保索引存在并追加logHeader声明了类型的列与富化字段的映射
+func ensureIndex(sp *SearchParam, logType string) {
+	sp.EsIndex = indexName(logType, time.Now())
+	properties := map[string]map[string]string{}
+	for i, v := range sp.LogHeader {
+		if sp.ColTypes[i] != "keyword" {
+			properties[v] = map[string]string{"type": sp.ColTypes[i]}
 		}
 	}
+	for k, v := range sp.Enrich.mapping() {
+		properties[k] = map[string]string{"type": v}
+	}
+	Indices.ensure(sp.EsIndex, properties)
+}
+
+// 日志检索，参数获取与初始化、doFile和doGzFile分别用来打开未压缩文件和压缩文件对文件内容做详细筛选。
+// 运行检索任务，返回回调RetUrl的内容；请求中的selectRegular格式错误时ok为false
+func runFreeSearch(data map[string]interface{}, fileList []string) (RetStruct, bool) {
+	startTime := handle.TimeParamToNano(data["startTime"].(float64), false)
+	endTime := handle.TimeParamToNano(data["endTime"].(float64), true)
+	taskId := fmt.Sprint(data["taskId"])
+	sp := newSearchParam(data)
+	if sp == nil {
+		return RetStruct{}, false
+	}
+	sp.StartTime, sp.EndTime = startTime, endTime
+	ensureIndex(sp, fmt.Sprint(data["logType"]))
+	if v, ok := data["scanWorkers"]; ok && int(v.(float64)) < ScanWorkers {
+		sp.ScanWorkers = int(v.(float64))
+	} else {
+		sp.ScanWorkers = ScanWorkers
+	}
+	timeout := MaxTimeoutSeconds
+	if v, ok := data["timeoutSeconds"]; ok && (timeout <= 0 || int(v.(float64)) < timeout) {
+		timeout = int(v.(float64))
+	}
+	if timeout > 0 {
+		sp.Deadline = time.Now().Add(time.Duration(timeout) * time.Second)
+	}
+	sp.MaxBytes = MaxBytesScanned
+	if v, ok := data["maxBytesScanned"]; ok && (sp.MaxBytes <= 0 || int64(v.(float64)) < sp.MaxBytes) {
+		sp.MaxBytes = int64(v.(float64))
+	}
+	if v, ok := data["aggregate"]; ok {
+		sp.Aggregate = newAggregator(v.(map[string]interface{}), sp.LogHeader, MaxAggGroups, MaxAggValues)
+		sp.MaxCount = math.MaxInt32
+	}
+	if v, ok := data["summary"]; ok {
+		sp.Summary = newSummarizer(v.(map[string]interface{}), sp.LogHeader, MaxTopValues)
+		sp.MaxCount = math.MaxInt32
+	}
+	if v, ok := data["sample"]; ok {
+		sp.Sample = newSampler(v.(map[string]interface{}))
+		if sp.Sample.holds() {
+			sp.MaxCount = math.MaxInt32
+		}
+	}
+	if v, ok := data["alert"]; ok {
+		sp.Alert = newAlerter(v.(map[string]interface{}))
+	}
+	if v, ok := data["contextBefore"]; ok {
+		sp.ContextBefore = int(v.(float64))
+	}
+	if v, ok := data["contextAfter"]; ok {
+		sp.ContextAfter = int(v.(float64))
+	}
 
 	var gzDict = map[string]int64{}
-	var nowCount int
-	var failCount int32
+	var gzLock sync.Mutex
+	st := &TaskStats{}
 	// 先用doFile过滤全部初筛文件，处理符合的未压缩文件，最终把检索到的行上传到ES；把可能符合的压缩文件保存在gzDict中
-	for _, file := range fileList {
-		doFile(file, startTime, endTime, taskId, esIndex, delimiter, datePositionRet, dateFormat, maxCount,
-			selectRegularList, deAllInOne, logHeaderList, &nowCount, &failCount, &gzDict)
-	}
+	scanFiles(fileList, sp.ScanWorkers, func(fileName string) {
+		if (sp.full(st) || st.stopped(sp, atomic.LoadInt64(&st.BytesScanned))) &&
+			!strings.HasSuffix(fileName, ".gz") {
+			return
+		}
+		if ts, ok := doFile(fileName, sp, st); ok {
+			gzLock.Lock()
+			gzDict[fileName] = ts
+			gzLock.Unlock()
+		}
+	})
 	if len(gzDict) != 0 {
 		// 对doFile筛选出的gz压缩文件进行再次筛选
 		gzFiles := sortFiles(gzDict)
 		gzFileList := getGzFile(gzFiles, startTime, endTime)
 		log.Println(gzFileList)
 		// 处理再次筛选后的压缩文件，最终把检索到的行上传到ES
-		for _, gzFile := range gzFileList {
-			doGzFile(gzFile, startTime, endTime, taskId, esIndex, delimiter, datePositionRet, dateFormat, maxCount,
-				selectRegularList, deAllInOne, logHeaderList, &nowCount, &failCount)
+		scanFiles(gzFileList, sp.ScanWorkers, func(fileName string) {
+			if sp.full(st) || st.stopped(sp, atomic.LoadInt64(&st.BytesScanned)) {
+				return
+			}
+			doGzFile(fileName, sp, st)
+		})
+	}
+
+	var aggRows []map[string]interface{}
+	if sp.Aggregate != nil {
+		aggRows = sp.Aggregate.Rows()
+	}
+	alert := sp.Alert.evaluate(aggRows)
+	if sp.Aggregate != nil {
+		if sp.Aggregate.Output == "es" {
+			for i, row := range aggRows {
+				st.uploads.Add(1)
+				go func(i int, row map[string]interface{}) {
+					defer st.uploads.Done()
+					inputESRow(i, row, sp, st)
+				}(i, row)
+			}
+			aggRows = nil
 		}
 	}
 
-	// 完成后回调接口
-	type RetStruct struct {
-		TaskId     string
-		HostName   string
-		DoneTs     int64
-		TotalCount int
-		FailCount  int32
+	if sp.Sample != nil && sp.Sample.holds() {
+		for _, rec := range sp.Sample.records() {
+			atomic.AddInt32(&st.Count, 1)
+			uploadRecord(rec, sp, st)
+		}
 	}
-	retSt := RetStruct{
-		TaskId:     taskId,
-		HostName:   check.HostName,
-		DoneTs:     time.Now().Unix(),
-		TotalCount: nowCount,
-		FailCount:  failCount,
+
+	var summary map[string]ColSummary
+	if sp.Summary != nil {
+		summary = sp.Summary.Result()
 	}
+
+	// 等待检索结果上传完成后回调接口
+	st.uploads.Wait()
+	return RetStruct{
+		TaskId:           taskId,
+		HostName:         check.HostName,
+		DoneTs:           time.Now().Unix(),
+		TotalCount:       int(st.Count),
+		FailCount:        st.FailCount,
+		LongCount:        st.LongCount,
+		BytesScanned:     st.BytesScanned,
+		TruncatedReason:  st.TruncatedReason(),
+		Aggregate:        aggRows,
+		Summary:          summary,
+		MatchedCount:     st.Matched,
+		ConvertFailCount: st.ConvertFailCount,
+		EsFailures:       st.EsFailures(),
+		SpooledCount:     st.SpooledCount,
+		Alert:            alert,
+	}, true
+}
+
+// 任务完成或被丢弃后回调RetUrl接口
+func postResult(retSt RetStruct) {
 	jsonBytes, _ := json.Marshal(retSt)
 	jsonMsg := string(jsonBytes)
 	log.Println(jsonMsg)
-	resp, err := http.Post(RetUrl, "text/json;charset=utf-8", strings.NewReader(jsonMsg))
+	resp, err := retClient.Post(RetUrl, "text/json;charset=utf-8", strings.NewReader(jsonMsg))
 	if err != nil {
 		log.Printf("post请求失败 error: %+v", err)
 		return
@@ -633,9 +1202,97 @@ func freeSearch(c *gin.Context) {
 		c.JSON(400, gin.H{"code": 400, "msg": msg})
 		return
 	}
-	c.JSON(200, gin.H{"code": 200, "msg": "Log search task is running"})
+	priority := PriorityInteractive
+	if fmt.Sprint(jsonMap["priority"]) == "batch" {
+		priority = PriorityBatch
+	}
+	task, pos, ok := Scheduler.admit(fmt.Sprint(jsonMap["taskId"]), fmt.Sprint(jsonMap["logType"]), priority)
+	if !ok {
+		c.JSON(429, gin.H{"code": 429, "msg": "Too many log search tasks, queue is full", "queuePosition": pos + 1})
+		return
+	}
+	if pos > 0 {
+		c.JSON(200, gin.H{"code": 200, "msg": "Log search task is queued", "queuePosition": pos})
+	} else {
+		c.JSON(200, gin.H{"code": 200, "msg": "Log search task is running"})
+	}
 	// 请求参数校验通过后，响应200后，正式开始运行检索任务。协程运行，传入请求参数和在设备上读取到的文件列表(初筛)
-	go runFreeSearch(jsonMap, filePathList)
+	go func() {
+		if !<-task.ready {
+			postResult(RetStruct{
+				TaskId:     task.TaskId,
+				HostName:   check.HostName,
+				DoneTs:     time.Now().Unix(),
+				DropReason: "Task waited in queue longer than " + Scheduler.maxWait.String(),
+			})
+			return
+		}
+		defer Scheduler.release(task)
+		if ret, ok := runFreeSearch(jsonMap, filePathList); ok {
+			postResult(ret)
+		}
+	}()
+}
+
+// /agent/queue，查看检索任务的运行与排队情况
+func queueStatus(c *gin.Context) {
+	running, queued := Scheduler.status()
+	c.JSON(200, gin.H{"code": 200, "maxTasks": Scheduler.maxTasks, "maxQueue": Scheduler.maxQueue,
+		"running": running, "queued": queued})
+}
+
+// /agent/spool，查看本地spool中等待重放的文档
+func spoolStatus(c *gin.Context) {
+	if Spool == nil {
+		c.JSON(200, gin.H{"code": 200, "enabled": false})
+		return
+	}
+	c.JSON(200, gin.H{"code": 200, "enabled": true, "spool": Spool.Status()})
+}
+
+// /agent/log/raw，按文档中的_file与_offset读取日志文件中前后的原始内容
+func rawFetch(c *gin.Context) {
+	jsonMap := make(map[string]interface{})
+	err := c.BindJSON(&jsonMap)
+	if err != nil {
+		c.JSON(400, gin.H{"code": 400, "msg": "Json format error!"})
+		return
+	}
+	var realPath string
+	msg, ok := check.RawCheck(jsonMap, RawAllowPaths, &realPath)
+	if !ok {
+		c.JSON(400, gin.H{"code": 400, "msg": msg})
+		return
+	}
+	before, after := int64(4096), int64(4096)
+	if v, ok := jsonMap["before"]; ok {
+		before = int64(v.(float64))
+	}
+	if v, ok := jsonMap["after"]; ok {
+		after = int64(v.(float64))
+	}
+	ret, err := readRaw(realPath, int64(jsonMap["offset"].(float64)), before, after)
+	if err != nil {
+		c.JSON(500, gin.H{"code": 500, "msg": err.Error()})
+		return
+	}
+	ret.File = fmt.Sprint(jsonMap["file"])
+	// 与检索结果相同，原始内容也执行[Privacy]与请求中的排除列和脱敏规则，按列的规则需要delimiter与logHeader
+	sp := &SearchParam{}
+	if v, ok := jsonMap["delimiter"]; ok {
+		sp.Delimiter = fmt.Sprint(v)
+	}
+	if v, ok := jsonMap["deAllInOne"]; ok {
+		sp.DeAllInOne = v.(bool)
+	}
+	logHeader, _ := jsonMap["logHeader"].([]interface{})
+	for _, v := range logHeader {
+		name, _ := handle.SplitColType(fmt.Sprint(v))
+		sp.LogHeader = append(sp.LogHeader, name)
+	}
+	sp.Fields = newFieldPolicy(jsonMap, sp.LogHeader)
+	redactRaw(&ret, sp)
+	c.JSON(200, gin.H{"code": 200, "raw": ret})
 }
 
 // /agent/run/script，运行运维脚本接口
@@ -673,6 +1330,24 @@ func GinHttps(isHttps bool) error {
 
 	r.POST("/agent/log/freeSearch", freeSearch)
 
+	r.POST("/agent/log/raw", rawFetch)
+
+	r.POST("/agent/log/tail", tailLog)
+
+	r.POST("/agent/log/tail/stop", tailStop)
+
+	r.POST("/agent/saved", savedPut)
+
+	r.POST("/agent/saved/delete", savedDelete)
+
+	r.GET("/agent/saved", savedList)
+
+	r.GET("/agent/queue", queueStatus)
+
+	r.GET("/agent/tail", tailStatus)
+
+	r.GET("/agent/spool", spoolStatus)
+
 	r.POST("/agent/run/script", script)
 
 	if isHttps {
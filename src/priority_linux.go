@@ -0,0 +1,28 @@
+package main
+
+import (
+	"runtime"
+	"syscall"
+)
+
+const (
+	ioprioWhoProcess = 1
+	ioprioClassShift = 13
+)
+
+// 降低当前扫描协程所在线程的CPU（nice）与IO（ionice）优先级。
+// 线程被锁定且不解锁，协程退出时Go会销毁该线程，优先级不会影响其他协程
+func lowerScanPriority() {
+	if ScanNice == 0 && ScanIoClass == 0 {
+		return
+	}
+	runtime.LockOSThread()
+	tid := syscall.Gettid()
+	if ScanNice != 0 {
+		_ = syscall.Setpriority(syscall.PRIO_PROCESS, tid, ScanNice)
+	}
+	if ScanIoClass != 0 {
+		prio := ScanIoClass<<ioprioClassShift | ScanIoLevel
+		_, _, _ = syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), uintptr(prio))
+	}
+}
@@ -0,0 +1,7 @@
+//go:build !linux
+
+package main
+
+// 非Linux系统不支持按线程设置优先级
+func lowerScanPriority() {
+}
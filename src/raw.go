@@ -0,0 +1,114 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"searchlog/handle"
+	"strings"
+)
+
+// RawResult 按文件偏移读取的原始内容，Start为Data在文件（压缩文件为解压后）中的起始偏移
+type RawResult struct {
+	File    string
+	Offset  int64
+	Start   int64
+	Data    string
+	Archive bool
+	// 已读到文件末尾
+	EOF bool
+	// Start位于行首（文件开头或前一字节为换行符）
+	lineStart bool
+}
+
+// readRaw 读取文件中offset前before字节到offset后after字节的原始内容，
+// 压缩文件按解压后的偏移读取（与文档中的_offset一致）
+func readRaw(fileName string, offset int64, before int64, after int64) (RawResult, error) {
+	ret := RawResult{File: fileName, Offset: offset, Archive: strings.HasSuffix(fileName, ".gz")}
+	ret.Start = offset - before
+	if ret.Start < 0 {
+		ret.Start = 0
+	}
+	size := offset + after - ret.Start
+	// 多读Start前的一个字节，用于判断Start是否位于行首
+	readStart := ret.Start
+	if readStart > 0 {
+		readStart--
+		size++
+	}
+	file, err := os.Open(fileName)
+	if err != nil {
+		return ret, err
+	}
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+	var r io.Reader = handle.LimitReader(file, ReadLimiter)
+	if ret.Archive {
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return ret, err
+		}
+		defer func(gr *gzip.Reader) {
+			_ = gr.Close()
+		}(gr)
+		if _, err = io.CopyN(io.Discard, gr, readStart); err != nil {
+			if err == io.EOF {
+				ret.EOF = true
+				return ret, nil
+			}
+			return ret, err
+		}
+		r = gr
+	} else if _, err = file.Seek(readStart, io.SeekStart); err != nil {
+		return ret, err
+	}
+	buf := make([]byte, size)
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		ret.EOF = true
+	} else if err != nil {
+		return ret, err
+	}
+	buf = buf[:n]
+	ret.lineStart = readStart == ret.Start
+	if readStart < ret.Start && n > 0 {
+		ret.lineStart = buf[0] == '\n'
+		buf = buf[1:]
+	}
+	ret.Data = string(buf)
+	return ret, nil
+}
+
+// redactRaw 按检索的脱敏规则处理原始内容：只保留完整的行（Start随之后移），
+// 每行按分隔符拆分后脱敏；没有分隔符时整行作为一列
+func redactRaw(ret *RawResult, sp *SearchParam) {
+	if sp.Fields == nil {
+		return
+	}
+	data := ret.Data
+	if !ret.lineStart {
+		i := strings.IndexByte(data, '\n')
+		if i < 0 {
+			data = ""
+		} else {
+			data = data[i+1:]
+		}
+		ret.Start += int64(len(ret.Data) - len(data))
+	}
+	if !ret.EOF {
+		data = data[:strings.LastIndexByte(data, '\n')+1]
+	}
+	lines := strings.Split(data, "\n")
+	for i, line := range lines {
+		if line == "" {
+			continue
+		}
+		if sp.Delimiter == "" {
+			lines[i] = sp.Fields.redact([]string{line})[0]
+		} else {
+			lines[i] = sp.Fields.redactLine(line, sp)
+		}
+	}
+	ret.Data = strings.Join(lines, "\n")
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// RedactSpec 脱敏规则：Type为mask（正则替换）、hash（加盐哈希）或ipTruncate（IPv4截断为/24，IPv6截断为/48），
+// Cols为列名或列号，"*"表示全部列
+type RedactSpec struct {
+	Cols    []string
+	Type    string
+	Regex   string
+	Replace string
+}
+
+// PrivacyPolicy 配置文件中一个脱敏配置节的排除列与脱敏规则
+type PrivacyPolicy struct {
+	Exclude []string
+	Rules   []RedactSpec
+}
+
+// 规则引用的具体列（不含"*"），用于检查请求中的logHeader
+func (p PrivacyPolicy) cols() []string {
+	var cols []string
+	for _, c := range p.Exclude {
+		if c = strings.TrimSpace(c); c != "*" {
+			cols = append(cols, c)
+		}
+	}
+	for _, spec := range p.Rules {
+		for _, c := range spec.Cols {
+			if c = strings.TrimSpace(c); c != "*" {
+				cols = append(cols, c)
+			}
+		}
+	}
+	return cols
+}
+
+// 一条已解析的脱敏规则，cols为nil时作用于全部列
+type redactRule struct {
+	cols    map[int]bool
+	typ     string
+	re      *regexp.Regexp
+	replace string
+}
+
+// fieldPolicy 上传前的字段投影与脱敏，合并配置文件与请求中的规则，在任何输出（ES、聚合、汇总）之前执行
+type fieldPolicy struct {
+	include map[int]bool
+	exclude map[int]bool
+	rules   []redactRule
+	salt    string
+}
+
+// 解析配置文件[Privacy]中的脱敏规则，格式：类型|列名,列名|正则|替换内容（正则中可以包含|，替换内容中不能包含）
+func parseRedactSpec(value string) (RedactSpec, error) {
+	parts := strings.SplitN(value, "|", 3)
+	spec := RedactSpec{Type: parts[0]}
+	if len(parts) > 1 {
+		spec.Cols = strings.Split(parts[1], ",")
+	}
+	if len(parts) > 2 {
+		spec.Regex = parts[2]
+		if i := strings.LastIndex(parts[2], "|"); i >= 0 {
+			spec.Regex, spec.Replace = parts[2][:i], parts[2][i+1:]
+		}
+	}
+	return spec, checkRedactSpec(spec)
+}
+
+func checkRedactSpec(spec RedactSpec) error {
+	switch spec.Type {
+	case "mask":
+		if _, err := regexp.Compile(spec.Regex); err != nil {
+			return err
+		}
+	case "hash", "ipTruncate":
+	default:
+		return fmt.Errorf("unknown redact type %s", spec.Type)
+	}
+	if len(spec.Cols) == 0 {
+		return fmt.Errorf("redact rule %s has no columns", spec.Type)
+	}
+	return nil
+}
+
+// 把列名或列号列表转换为列下标集合，包含"*"时返回nil
+func colSet(cols []string, logHeader []string) map[int]bool {
+	set := map[int]bool{}
+	for _, c := range cols {
+		c = strings.TrimSpace(c)
+		if c == "*" {
+			return nil
+		}
+		var ref interface{} = c
+		if n, err := strconv.ParseFloat(c, 64); err == nil {
+			ref = n
+		}
+		if i := colIndex(ref, logHeader); i >= 0 {
+			set[i] = true
+		}
+	}
+	return set
+}
+
+// 生成检索任务的字段策略：配置文件[Privacy]与请求的logType对应的[Privacy.<logType>]中的排除列与脱敏规则始终生效，
+// 后者按列号配置，不依赖请求中的logHeader；请求中的规则追加在后
+func newFieldPolicy(data map[string]interface{}, logHeader []string) *fieldPolicy {
+	fp := &fieldPolicy{exclude: map[int]bool{}, salt: PrivacySalt}
+	typed := PrivacyTypes[fmt.Sprint(data["logType"])]
+	for _, exclude := range [][]string{PrivacyExclude, typed.Exclude} {
+		for i := range colSet(exclude, logHeader) {
+			fp.exclude[i] = true
+		}
+	}
+	specs := append(append([]RedactSpec(nil), PrivacyRules...), typed.Rules...)
+	if fields, ok := data["fields"].(map[string]interface{}); ok {
+		if v, ok := fields["include"].([]interface{}); ok {
+			fp.include = colSet(toStrings(v), logHeader)
+		}
+		if v, ok := fields["exclude"].([]interface{}); ok {
+			for i := range colSet(toStrings(v), logHeader) {
+				fp.exclude[i] = true
+			}
+		}
+	}
+	if rules, ok := data["redact"].([]interface{}); ok {
+		for _, r := range rules {
+			rMap := r.(map[string]interface{})
+			spec := RedactSpec{Type: fmt.Sprint(rMap["type"])}
+			if cols, ok := rMap["cols"].([]interface{}); ok {
+				spec.Cols = toStrings(cols)
+			}
+			if v, ok := rMap["regex"]; ok {
+				spec.Regex = fmt.Sprint(v)
+			}
+			if v, ok := rMap["replace"]; ok {
+				spec.Replace = fmt.Sprint(v)
+			}
+			specs = append(specs, spec)
+		}
+	}
+	for _, spec := range specs {
+		rule := redactRule{cols: colSet(spec.Cols, logHeader), typ: spec.Type, replace: spec.Replace}
+		if spec.Type == "mask" {
+			rule.re = regexp.MustCompile(spec.Regex)
+		}
+		fp.rules = append(fp.rules, rule)
+	}
+	if fp.include == nil && len(fp.exclude) == 0 && len(fp.rules) == 0 {
+		return nil
+	}
+	return fp
+}
+
+func toStrings(list []interface{}) []string {
+	var ret []string
+	for _, v := range list {
+		ret = append(ret, fmt.Sprint(v))
+	}
+	return ret
+}
+
+// keep 该列是否需要输出
+func (fp *fieldPolicy) keep(i int) bool {
+	if fp == nil {
+		return true
+	}
+	if fp.include != nil && !fp.include[i] {
+		return false
+	}
+	return !fp.exclude[i]
+}
+
+// 对一个值执行脱敏规则
+func (fp *fieldPolicy) redactValue(rule redactRule, v string) string {
+	switch rule.typ {
+	case "mask":
+		return rule.re.ReplaceAllString(v, rule.replace)
+	case "hash":
+		sum := sha256.Sum256([]byte(fp.salt + v))
+		return hex.EncodeToString(sum[:8])
+	case "ipTruncate":
+		ip := net.ParseIP(v)
+		if ip == nil {
+			return v
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4.Mask(net.CIDRMask(24, 32)).String()
+		}
+		return ip.Mask(net.CIDRMask(48, 128)).String()
+	}
+	return v
+}
+
+// redact 返回投影与脱敏后的列（不修改原切片），不输出的列置为空字符串
+func (fp *fieldPolicy) redact(strList []string) []string {
+	if fp == nil {
+		return strList
+	}
+	ret := make([]string, len(strList))
+	for i, v := range strList {
+		if !fp.keep(i) {
+			continue
+		}
+		for _, rule := range fp.rules {
+			if rule.cols == nil || rule.cols[i] {
+				v = fp.redactValue(rule, v)
+			}
+		}
+		ret[i] = v
+	}
+	return ret
+}
+
+// redactLine 对上下文中的原始行按同样的分割规则拆分后脱敏，再用分隔符拼接
+func (fp *fieldPolicy) redactLine(line string, sp *SearchParam) string {
+	if fp == nil {
+		return line
+	}
+	var kept []string
+	for i, v := range fp.redact(strSplit(line, sp.Delimiter, sp.DeAllInOne)) {
+		if fp.keep(i) {
+			kept = append(kept, v)
+		}
+	}
+	return strings.Join(kept, sp.Delimiter)
+}
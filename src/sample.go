@@ -0,0 +1,80 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 抽样结果：不上传、立即上传、放入蓄水池待任务结束后上传
+const (
+	sampleSkip = iota
+	sampleUpload
+	sampleHold
+)
+
+// sampler 对符合条件的日志抽样，使上传的日志覆盖整个检索时间窗口：
+// reservoir为蓄水池抽样（在全部匹配中均匀抽取size条），systematic为系统抽样（每every条取1条）
+type sampler struct {
+	mu        sync.Mutex
+	mode      string
+	size      int
+	every     int64
+	seen      int64
+	reservoir []*LogRecord
+	rnd       *rand.Rand
+}
+
+// 根据请求中的sample参数生成抽样器，参数已由check.FreeSearchCheck校验
+func newSampler(data map[string]interface{}) *sampler {
+	s := &sampler{mode: "reservoir", rnd: rand.New(rand.NewSource(time.Now().UnixNano()))}
+	if v, ok := data["mode"]; ok {
+		s.mode = v.(string)
+	}
+	if v, ok := data["size"]; ok {
+		s.size = int(v.(float64))
+	}
+	if v, ok := data["every"]; ok {
+		s.every = int64(v.(float64))
+	}
+	return s
+}
+
+// pick 对一条符合条件的日志抽样，返回sampleSkip/sampleUpload/sampleHold
+func (s *sampler) pick(rec *LogRecord) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seen++
+	if s.mode == "systematic" {
+		if (s.seen-1)%s.every == 0 {
+			return sampleUpload
+		}
+		return sampleSkip
+	}
+	if len(s.reservoir) < s.size {
+		s.reservoir = append(s.reservoir, rec)
+		return sampleHold
+	}
+	if j := s.rnd.Int63n(s.seen); j < int64(s.size) {
+		s.reservoir[j] = rec
+		return sampleHold
+	}
+	return sampleSkip
+}
+
+// 蓄水池抽样只在任务结束后上传
+func (s *sampler) holds() bool {
+	return s.mode != "systematic"
+}
+
+// records 返回蓄水池中的日志，按时间排序
+func (s *sampler) records() []*LogRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := append([]*LogRecord(nil), s.reservoir...)
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Ts < list[j].Ts
+	})
+	return list
+}
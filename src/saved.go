@@ -0,0 +1,375 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"searchlog/check"
+	"searchlog/handle"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 检查定期检索是否到期的间隔
+const savedTick = 10 * time.Second
+
+// 单次运行检索的最长时间范围，与FreeSearchCheck的限制相同
+const savedMaxWindow = 24 * 60 * 60
+
+// SavedSearch 在agent上定期运行的检索。Search为freeSearch的请求内容（不含hostName、startTime、endTime与taskId），
+// 按Cron或IntervalSeconds运行，每次检索上次成功运行的结束时间（Checkpoint）到当前时间的日志
+type SavedSearch struct {
+	Id              string
+	Search          map[string]interface{}
+	Cron            string `json:",omitempty"`
+	IntervalSeconds int    `json:",omitempty"`
+	// 阈值告警参数，见newAlerter
+	Alert     map[string]interface{} `json:",omitempty"`
+	CreatedTs int64
+	// 上次开始运行的时间（秒）
+	LastRunTs int64 `json:",omitempty"`
+	// 上次成功运行检索到的时间（秒），下次从这里开始
+	Checkpoint int64 `json:",omitempty"`
+	// 上次运行失败的原因，成功时为空
+	LastError string `json:",omitempty"`
+	RunCount  int
+	FailCount int
+	// 上次发出告警的时间（秒）与告警次数
+	LastAlertTs int64 `json:",omitempty"`
+	AlertCount  int   `json:",omitempty"`
+	NextRunTs   int64 `json:",omitempty"`
+	cron        *handle.Cron
+	running     bool
+}
+
+// 下次运行的时间，cron表达式没有满足的时间时返回零值
+func (ss *SavedSearch) next() time.Time {
+	base := time.Unix(ss.CreatedTs, 0)
+	if ss.LastRunTs > 0 {
+		base = time.Unix(ss.LastRunTs, 0)
+	}
+	if ss.cron != nil {
+		return ss.cron.Next(base)
+	}
+	return base.Add(time.Duration(ss.IntervalSeconds) * time.Second)
+}
+
+// savedStore 定期检索的注册表，每个检索保存为dir下的<id>.json，运行进度随之保存，agent重启后继续
+type savedStore struct {
+	mu       sync.Mutex
+	dir      string
+	max      int
+	lag      time.Duration
+	searches map[string]*SavedSearch
+}
+
+// 打开定期检索目录并加载已注册的检索；dir为空时不启用，返回nil
+func openSavedStore(dir string, max int, lag time.Duration) (*savedStore, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &savedStore{dir: dir, max: max, lag: lag, searches: map[string]*SavedSearch{}}
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		ss := &SavedSearch{}
+		if err = json.Unmarshal(data, ss); err != nil {
+			log.Printf("定期检索%s格式错误：%s", f, err)
+			continue
+		}
+		if ss.Cron != "" {
+			if ss.cron, err = handle.ParseCron(ss.Cron); err != nil {
+				log.Printf("定期检索%s的cron表达式错误：%s", f, err)
+				continue
+			}
+		}
+		s.searches[ss.Id] = ss
+	}
+	return s, nil
+}
+
+// 写入检索的文件（先写临时文件再改名），调用时持有锁
+func (s *savedStore) save(ss *SavedSearch) error {
+	data, err := json.MarshalIndent(ss, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(s.dir, ss.Id+".json")
+	if err = os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// put 注册或更新一个检索；更新时保留原有的运行进度
+func (s *savedStore) put(ss *SavedSearch) error {
+	if ss.Cron != "" {
+		var err error
+		if ss.cron, err = handle.ParseCron(ss.Cron); err != nil {
+			return err
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old, ok := s.searches[ss.Id]; ok {
+		// 在原对象上更新，正在运行的一次结束时仍能记录进度
+		old.Search, old.Cron, old.cron, old.IntervalSeconds = ss.Search, ss.Cron, ss.cron, ss.IntervalSeconds
+		old.Alert = ss.Alert
+		ss = old
+	} else if len(s.searches) >= s.max {
+		return fmt.Errorf("too many saved searches, max %d", s.max)
+	} else {
+		ss.CreatedTs = time.Now().Unix()
+	}
+	ss.NextRunTs = ss.next().Unix()
+	if err := s.save(ss); err != nil {
+		return err
+	}
+	s.searches[ss.Id] = ss
+	return nil
+}
+
+// remove 删除一个检索，正在运行的一次不受影响；不存在时返回false
+func (s *savedStore) remove(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.searches[id]; !ok {
+		return false
+	}
+	delete(s.searches, id)
+	if err := os.Remove(filepath.Join(s.dir, id+".json")); err != nil {
+		log.Println(err)
+	}
+	return true
+}
+
+func (s *savedStore) list() []SavedSearch {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := []SavedSearch{}
+	for _, ss := range s.searches {
+		ret = append(ret, *ss)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Id < ret[j].Id
+	})
+	return ret
+}
+
+// run 定期启动到期的检索，同一个检索上次运行未结束时不重复启动
+func (s *savedStore) run() {
+	for range time.Tick(savedTick) {
+		now := time.Now()
+		s.mu.Lock()
+		for _, ss := range s.searches {
+			if next := ss.next(); ss.running || next.IsZero() || now.Before(next) {
+				continue
+			}
+			ss.running = true
+			ss.LastRunTs = now.Unix()
+			go s.execute(ss, now)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// execute 运行一次检索，时间范围为上次成功运行的结束时间到当前时间减去lag（等待日志写入），最长24小时。
+// 以批量优先级进入检索任务调度，结果写入ES并回调RetUrl；写入ES全部成功后才推进Checkpoint，
+// 失败时下次重新检索同一时间范围，taskId相同，已写入的文档被覆盖
+func (s *savedStore) execute(ss *SavedSearch, now time.Time) {
+	s.mu.Lock()
+	start, end := ss.Checkpoint, now.Add(-s.lag).Unix()
+	if start == 0 {
+		start = ss.CreatedTs
+	}
+	data := map[string]interface{}{}
+	for k, v := range ss.Search {
+		data[k] = v
+	}
+	alert := ss.Alert
+	lastAlert := ss.LastAlertTs
+	s.mu.Unlock()
+	if end-start > savedMaxWindow {
+		log.Printf("定期检索%s超过24小时未成功运行，跳过%d秒的日志", ss.Id, end-savedMaxWindow-start)
+		start = end - savedMaxWindow
+	}
+	ret, ok := RetStruct{}, false
+	if end > start {
+		ret, ok = s.search(ss.Id, data, alert, start, end)
+	}
+	alerted := ok && ret.Alert != nil && ret.Alert.Triggered && s.alert(ret, alert, lastAlert, now)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ss.running = false
+	if end <= start {
+		ss.NextRunTs = ss.next().Unix()
+		return
+	}
+	ss.RunCount++
+	if alerted {
+		ss.LastAlertTs = now.Unix()
+		ss.AlertCount++
+	}
+	switch {
+	case !ok:
+		ss.FailCount++
+		ss.LastError = ret.DropReason
+	case ret.FailCount > 0:
+		ss.FailCount++
+		ss.LastError = fmt.Sprintf("%d documents failed to write", ret.FailCount)
+	case ret.TruncatedReason != "":
+		// 提前结束的检索没有覆盖整个时间范围，不推进进度，下次从同一位置重新检索
+		ss.FailCount++
+		ss.LastError = "truncated by " + ret.TruncatedReason
+	default:
+		ss.LastError = ""
+		ss.Checkpoint = end
+	}
+	ss.NextRunTs = ss.next().Unix()
+	// 运行期间被删除的检索不再保存
+	if s.searches[ss.Id] == ss {
+		if err := s.save(ss); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// 超过阈值时回调告警webhook，距上次告警不足cooldownSeconds时不重复告警；成功发出告警时返回true
+func (s *savedStore) alert(ret RetStruct, alert map[string]interface{}, lastAlert int64, now time.Time) bool {
+	if v, ok := alert["cooldownSeconds"]; ok && now.Unix()-lastAlert < int64(v.(float64)) {
+		return false
+	}
+	err := postAlert(AlertEvent{
+		SavedId:     ret.SavedId,
+		TaskId:      ret.TaskId,
+		HostName:    ret.HostName,
+		AlertTs:     now.Unix(),
+		WindowStart: ret.WindowStart,
+		WindowEnd:   ret.WindowEnd,
+		AlertResult: *ret.Alert,
+	})
+	if err != nil {
+		log.Printf("定期检索%s的告警回调失败：%s", ret.SavedId, err)
+		return false
+	}
+	return true
+}
+
+// 检索[start, end)之间的日志并回调RetUrl，alert不为nil时同时判断告警；未能运行时ok为false，原因在DropReason中
+func (s *savedStore) search(id string, data map[string]interface{}, alert map[string]interface{}, start int64, end int64) (RetStruct, bool) {
+	taskId := id + strconv.FormatInt(start, 10)
+	data["hostName"] = check.HostName
+	data["taskId"] = taskId
+	data["startTime"] = float64(start)
+	data["endTime"] = float64(end - 1)
+	ret := RetStruct{TaskId: taskId, HostName: check.HostName, SavedId: id, WindowStart: start, WindowEnd: end}
+	drop := func(reason string) (RetStruct, bool) {
+		ret.DoneTs = time.Now().Unix()
+		ret.DropReason = reason
+		postResult(ret)
+		return ret, false
+	}
+	var filePathList []string
+	if msg, ok := check.FreeSearchCheck(data, &filePathList); !ok {
+		return drop(msg)
+	}
+	if alert != nil {
+		data["alert"] = alert
+	}
+	task, _, ok := Scheduler.admit(taskId, fmt.Sprint(data["logType"]), PriorityBatch)
+	if !ok {
+		return drop("Too many log search tasks, queue is full")
+	}
+	if !<-task.ready {
+		return drop("Task waited in queue longer than " + Scheduler.maxWait.String())
+	}
+	defer Scheduler.release(task)
+	result, ok := runFreeSearch(data, filePathList)
+	if !ok {
+		return drop("Error parameter selectRegular,info: value format error")
+	}
+	result.SavedId, result.WindowStart, result.WindowEnd = id, start, end
+	postResult(result)
+	return result, true
+}
+
+// /agent/saved，注册或更新定期检索
+func savedPut(c *gin.Context) {
+	if Saved == nil {
+		c.JSON(400, gin.H{"code": 400, "msg": "Saved searches are disabled"})
+		return
+	}
+	jsonMap := make(map[string]interface{})
+	err := c.BindJSON(&jsonMap)
+	if err != nil {
+		c.JSON(400, gin.H{"code": 400, "msg": "Json format error!"})
+		return
+	}
+	msg, ok := check.SavedCheck(jsonMap)
+	if !ok {
+		c.JSON(400, gin.H{"code": 400, "msg": msg})
+		return
+	}
+	ss := &SavedSearch{Id: fmt.Sprint(jsonMap["id"]), Search: jsonMap["search"].(map[string]interface{})}
+	if v, ok := jsonMap["alert"]; ok {
+		ss.Alert = v.(map[string]interface{})
+	}
+	if v, ok := jsonMap["cron"]; ok {
+		ss.Cron = fmt.Sprint(v)
+	} else {
+		ss.IntervalSeconds = int(jsonMap["intervalSeconds"].(float64))
+	}
+	if err = Saved.put(ss); err != nil {
+		c.JSON(400, gin.H{"code": 400, "msg": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"code": 200, "msg": "Saved search is registered"})
+}
+
+// /agent/saved/delete，删除定期检索
+func savedDelete(c *gin.Context) {
+	if Saved == nil {
+		c.JSON(400, gin.H{"code": 400, "msg": "Saved searches are disabled"})
+		return
+	}
+	jsonMap := make(map[string]interface{})
+	err := c.BindJSON(&jsonMap)
+	if err != nil {
+		c.JSON(400, gin.H{"code": 400, "msg": "Json format error!"})
+		return
+	}
+	msg, ok := check.SavedDeleteCheck(jsonMap)
+	if !ok {
+		c.JSON(400, gin.H{"code": 400, "msg": msg})
+		return
+	}
+	if !Saved.remove(fmt.Sprint(jsonMap["id"])) {
+		c.JSON(404, gin.H{"code": 404, "msg": "Saved search not found"})
+		return
+	}
+	c.JSON(200, gin.H{"code": 200, "msg": "Saved search is deleted"})
+}
+
+// /agent/saved，查看定期检索及其运行进度
+func savedList(c *gin.Context) {
+	if Saved == nil {
+		c.JSON(200, gin.H{"code": 200, "enabled": false})
+		return
+	}
+	c.JSON(200, gin.H{"code": 200, "enabled": true, "searches": Saved.list()})
+}
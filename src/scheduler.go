@@ -0,0 +1,155 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// 检索任务优先级
+const (
+	PriorityBatch       = 0
+	PriorityInteractive = 1
+)
+
+var priorityNames = map[int]string{PriorityBatch: "batch", PriorityInteractive: "interactive"}
+
+// QueueTask 调度器中运行或排队的任务
+type QueueTask struct {
+	TaskId   string
+	LogType  string
+	Priority string
+	// 进入队列或开始运行的时间戳（秒）
+	Ts       int64
+	priority int
+	ready    chan bool
+}
+
+// taskScheduler 检索任务调度器：限制同时运行的任务数，排队任务按优先级调度，
+// 同优先级时优先运行正在运行任务数最少的logType，再按排队先后；排队超时的任务被丢弃
+type taskScheduler struct {
+	mu         sync.Mutex
+	maxTasks   int
+	maxQueue   int
+	maxWait    time.Duration
+	running    map[*QueueTask]bool
+	runningLog map[string]int
+	queue      []*QueueTask
+}
+
+func newTaskScheduler(maxTasks int, maxQueue int, maxWait time.Duration) *taskScheduler {
+	if maxTasks < 1 {
+		maxTasks = 1
+	}
+	ts := &taskScheduler{
+		maxTasks:   maxTasks,
+		maxQueue:   maxQueue,
+		maxWait:    maxWait,
+		running:    map[*QueueTask]bool{},
+		runningLog: map[string]int{},
+	}
+	if maxWait > 0 {
+		go ts.expireLoop()
+	}
+	return ts
+}
+
+// admit 申请运行一个任务：从t.ready读到true时开始运行，读到false表示排队超时被丢弃；
+// pos为排队位置（0表示立即运行）。队列已满时ok为false，pos为队列长度
+func (ts *taskScheduler) admit(taskId string, logType string, priority int) (t *QueueTask, pos int, ok bool) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	t = &QueueTask{
+		TaskId:   taskId,
+		LogType:  logType,
+		Priority: priorityNames[priority],
+		Ts:       time.Now().Unix(),
+		priority: priority,
+		ready:    make(chan bool, 1),
+	}
+	if len(ts.running) < ts.maxTasks {
+		ts.start(t)
+		return t, 0, true
+	}
+	if len(ts.queue) >= ts.maxQueue {
+		return nil, len(ts.queue), false
+	}
+	ts.queue = append(ts.queue, t)
+	for _, q := range ts.queue {
+		if q.priority >= priority {
+			pos++
+		}
+	}
+	return t, pos, true
+}
+
+// 加锁后调用，把任务标记为运行中并通知其开始
+func (ts *taskScheduler) start(t *QueueTask) {
+	t.Ts = time.Now().Unix()
+	ts.running[t] = true
+	ts.runningLog[t.LogType]++
+	t.ready <- true
+}
+
+// release 任务结束，按调度规则运行下一个排队任务
+func (ts *taskScheduler) release(t *QueueTask) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if !ts.running[t] {
+		return
+	}
+	delete(ts.running, t)
+	ts.runningLog[t.LogType]--
+	if ts.runningLog[t.LogType] <= 0 {
+		delete(ts.runningLog, t.LogType)
+	}
+	for len(ts.running) < ts.maxTasks && len(ts.queue) > 0 {
+		best := 0
+		for i, q := range ts.queue[1:] {
+			b := ts.queue[best]
+			if q.priority > b.priority || q.priority == b.priority && ts.runningLog[q.LogType] < ts.runningLog[b.LogType] {
+				best = i + 1
+			}
+		}
+		next := ts.queue[best]
+		ts.queue = append(ts.queue[:best], ts.queue[best+1:]...)
+		ts.start(next)
+	}
+}
+
+// 定期丢弃排队超过maxWait的任务
+func (ts *taskScheduler) expireLoop() {
+	for range time.Tick(time.Second) {
+		deadline := time.Now().Add(-ts.maxWait).Unix()
+		ts.mu.Lock()
+		remain := ts.queue[:0]
+		for _, q := range ts.queue {
+			if q.Ts < deadline {
+				q.ready <- false
+			} else {
+				remain = append(remain, q)
+			}
+		}
+		ts.queue = remain
+		ts.mu.Unlock()
+	}
+}
+
+// status 返回运行中与排队中的任务，排队任务按调度顺序的近似排列（优先级高、排队早的在前）
+func (ts *taskScheduler) status() (running []QueueTask, queued []QueueTask) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	for t := range ts.running {
+		running = append(running, *t)
+	}
+	sort.Slice(running, func(i, j int) bool {
+		return running[i].Ts < running[j].Ts
+	})
+	for _, t := range ts.queue {
+		queued = append(queued, *t)
+	}
+	sort.SliceStable(queued, func(i, j int) bool {
+		return queued[i].priority > queued[j].priority
+	})
+	return running, queued
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 单个spool文件的大小上限，超出后写入新文件
+const spoolSegmentBytes = 16 * 1024 * 1024
+
+// 重放时每处理多少条记录保存一次进度
+const spoolCursorEvery = 100
+
+// spoolRecord spool中的一条待上传文档
+type spoolRecord struct {
+	Ts     int64
+	TaskId string
+	Index  string
+	Id     string
+	Create bool
+	Doc    json.RawMessage
+}
+
+// spoolSegment 一个spool文件，tasks为各任务尚未重放的记录数
+type spoolSegment struct {
+	seq    int64
+	path   string
+	size   int64
+	newest int64
+	tasks  map[string]int
+}
+
+// diskSpool ES不可用时暂存上传失败的文档，ES恢复后按写入顺序重放。
+// 记录按行追加到dir下编号递增的文件中，重放进度保存在cursor文件中；总大小超过maxBytes时不再接收新记录，
+// 超过ttl未能重放的文件被删除。spool中有待重放的记录时新文档也直接写入spool，保持上传顺序
+type diskSpool struct {
+	mu       sync.Mutex
+	dir      string
+	maxBytes int64
+	ttl      time.Duration
+	segments []*spoolSegment
+	bytes    int64
+	// 第一个文件中已重放的字节数
+	offset  int64
+	writer  *os.File
+	dropped int64
+	expired int64
+}
+
+// SpoolStatus spool状态，OldestTs为最早一条待重放记录的写入时间（秒）
+type SpoolStatus struct {
+	Bytes    int64
+	MaxBytes int64
+	Segments int
+	OldestTs int64          `json:",omitempty"`
+	Pending  map[string]int `json:",omitempty"`
+	Dropped  int64
+	Expired  int64
+}
+
+// 打开spool目录，恢复上次未重放完的记录；dir为空时不启用spool，返回nil
+func openDiskSpool(dir string, maxBytes int64, ttl time.Duration) (*diskSpool, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &diskSpool{dir: dir, maxBytes: maxBytes, ttl: ttl}
+	var cursorSeq int64
+	if data, err := os.ReadFile(filepath.Join(dir, "cursor")); err == nil {
+		_, _ = fmt.Sscan(string(data), &cursorSeq, &s.offset)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.spool"))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		seq, err := strconv.ParseInt(strings.TrimSuffix(filepath.Base(f), ".spool"), 10, 64)
+		if err != nil {
+			continue
+		}
+		s.segments = append(s.segments, &spoolSegment{seq: seq, path: f, tasks: map[string]int{}})
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i].seq < s.segments[j].seq })
+	for len(s.segments) > 0 && s.segments[0].seq < cursorSeq {
+		// 已重放完但未删除的文件
+		_ = os.Remove(s.segments[0].path)
+		s.segments = s.segments[1:]
+	}
+	if len(s.segments) == 0 || s.segments[0].seq != cursorSeq {
+		s.offset = 0
+	}
+	for i, seg := range s.segments {
+		var start int64
+		if i == 0 {
+			start = s.offset
+		}
+		if err := seg.load(start); err != nil {
+			return nil, err
+		}
+		s.bytes += seg.size
+	}
+	return s, nil
+}
+
+// 统计文件中从start开始的记录；写入中断留下的不完整的最后一行被截掉
+func (seg *spoolSegment) load(start int64) error {
+	f, err := os.Open(seg.path)
+	if err != nil {
+		return err
+	}
+	defer func(f *os.File) {
+		_ = f.Close()
+	}(f)
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	seg.size = info.Size()
+	if _, err = f.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+	br := bufio.NewReader(f)
+	pos := start
+	for {
+		line, err := br.ReadBytes('\n')
+		if err != nil {
+			if pos < seg.size {
+				log.Printf("spool文件%s末尾有%d字节不完整的记录，已截掉", seg.path, seg.size-pos)
+				if err = os.Truncate(seg.path, pos); err != nil {
+					log.Println(err)
+				}
+				seg.size = pos
+			}
+			return nil
+		}
+		pos += int64(len(line))
+		var rec spoolRecord
+		if json.Unmarshal(line, &rec) == nil {
+			seg.tasks[rec.TaskId]++
+			if rec.Ts > seg.newest {
+				seg.newest = rec.Ts
+			}
+		}
+	}
+}
+
+// active 是否有待重放的记录
+func (s *diskSpool) active() bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.segments) > 0
+}
+
+// add 追加一条记录，spool已满或写入失败时返回false
+func (s *diskSpool) add(taskId string, index string, id string, create bool, doc interface{}) bool {
+	if s == nil {
+		return false
+	}
+	marshal, err := json.Marshal(doc)
+	if err != nil {
+		return false
+	}
+	rec := spoolRecord{Ts: time.Now().Unix(), TaskId: taskId, Index: index, Id: id, Create: create, Doc: marshal}
+	line, _ := json.Marshal(rec)
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.maxBytes > 0 && s.bytes+int64(len(line)) > s.maxBytes {
+		s.dropped++
+		return false
+	}
+	var seg *spoolSegment
+	if n := len(s.segments); n > 0 && s.writer != nil && s.segments[n-1].size < spoolSegmentBytes {
+		seg = s.segments[n-1]
+	} else {
+		seq := time.Now().UnixNano()
+		if n > 0 && s.segments[n-1].seq >= seq {
+			seq = s.segments[n-1].seq + 1
+		}
+		seg = &spoolSegment{seq: seq, path: filepath.Join(s.dir, strconv.FormatInt(seq, 10)+".spool"), tasks: map[string]int{}}
+		f, err := os.OpenFile(seg.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			log.Println(err)
+			return false
+		}
+		if s.writer != nil {
+			_ = s.writer.Close()
+		}
+		s.writer = f
+		if len(s.segments) == 0 {
+			s.offset = 0
+		}
+		s.segments = append(s.segments, seg)
+	}
+	if _, err = s.writer.Write(line); err != nil {
+		log.Println(err)
+		// 截掉写入了一部分的记录，避免之后的记录接在不完整的行后面
+		if err = s.writer.Truncate(seg.size); err != nil {
+			log.Println(err)
+		}
+		return false
+	}
+	seg.size += int64(len(line))
+	seg.newest = rec.Ts
+	seg.tasks[taskId]++
+	s.bytes += int64(len(line))
+	return true
+}
+
+// 保存重放进度，调用时持有锁
+func (s *diskSpool) saveCursor() {
+	var seq int64
+	if len(s.segments) > 0 {
+		seq = s.segments[0].seq
+	}
+	_ = os.WriteFile(filepath.Join(s.dir, "cursor"), []byte(fmt.Sprintf("%d %d", seq, s.offset)), 0644)
+}
+
+// 删除第一个文件，调用时持有锁
+func (s *diskSpool) removeFirst() {
+	seg := s.segments[0]
+	if len(s.segments) == 1 && s.writer != nil {
+		_ = s.writer.Close()
+		s.writer = nil
+	}
+	_ = os.Remove(seg.path)
+	s.bytes -= seg.size
+	s.segments = s.segments[1:]
+	s.offset = 0
+	s.saveCursor()
+}
+
+// expire 删除超过ttl未能重放的文件
+func (s *diskSpool) expire() {
+	if s.ttl <= 0 {
+		return
+	}
+	deadline := time.Now().Add(-s.ttl).Unix()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.segments) > 0 && s.segments[0].newest < deadline {
+		for _, n := range s.segments[0].tasks {
+			s.expired += int64(n)
+		}
+		s.removeFirst()
+	}
+}
+
+// replay 按顺序重放记录，ES写入失败时停止，等待下一轮
+func (s *diskSpool) replay() {
+	for {
+		s.mu.Lock()
+		if len(s.segments) == 0 {
+			s.mu.Unlock()
+			return
+		}
+		seg, offset, size := s.segments[0], s.offset, s.segments[0].size
+		if offset >= size {
+			// 最后一个文件也已重放完时一并删除，之后的文档直接写入ES
+			s.removeFirst()
+			s.mu.Unlock()
+			continue
+		}
+		s.mu.Unlock()
+		if !s.replaySegment(seg, offset, size) {
+			return
+		}
+	}
+}
+
+// 重放一个文件中offset到size之间的记录，全部成功时返回true
+func (s *diskSpool) replaySegment(seg *spoolSegment, offset int64, size int64) bool {
+	f, err := os.Open(seg.path)
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	defer func(f *os.File) {
+		_ = f.Close()
+	}(f)
+	if _, err = f.Seek(offset, io.SeekStart); err != nil {
+		return false
+	}
+	br := bufio.NewReader(io.LimitReader(f, size-offset))
+	deadline := time.Now().Add(-s.ttl).Unix()
+	done := 0
+	defer func() {
+		s.mu.Lock()
+		s.saveCursor()
+		s.mu.Unlock()
+	}()
+	for {
+		line, err := br.ReadBytes('\n')
+		if err != nil {
+			if len(line) > 0 {
+				// 不完整的最后一行无法重放，跳过，避免offset停在这里反复重放
+				log.Printf("spool文件%s跳过%d字节不完整的记录", seg.path, len(line))
+				s.mu.Lock()
+				s.offset += int64(len(line))
+				s.mu.Unlock()
+			}
+			return true
+		}
+		var rec spoolRecord
+		if json.Unmarshal(line, &rec) == nil {
+			if s.ttl > 0 && rec.Ts < deadline {
+				s.mu.Lock()
+				s.expired++
+				s.mu.Unlock()
+			} else if err = esClient.Index(rec.Index, rec.Id, rec.Doc, rec.Create, nil); err != nil && retryable(err) {
+				return false
+			} else if err != nil {
+				log.Println("spool记录重放失败：", err)
+			}
+		}
+		s.mu.Lock()
+		s.offset += int64(len(line))
+		if seg.tasks[rec.TaskId]--; seg.tasks[rec.TaskId] <= 0 {
+			delete(seg.tasks, rec.TaskId)
+		}
+		if done++; done%spoolCursorEvery == 0 {
+			s.saveCursor()
+		}
+		s.mu.Unlock()
+	}
+}
+
+// run 定期删除过期文件并重放记录
+func (s *diskSpool) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		s.expire()
+		s.replay()
+	}
+}
+
+// 读取第一条待重放记录的写入时间
+func (s *diskSpool) oldestTs() int64 {
+	if len(s.segments) == 0 {
+		return 0
+	}
+	f, err := os.Open(s.segments[0].path)
+	if err != nil {
+		return 0
+	}
+	defer func(f *os.File) {
+		_ = f.Close()
+	}(f)
+	if _, err = f.Seek(s.offset, io.SeekStart); err != nil {
+		return 0
+	}
+	line, err := bufio.NewReader(f).ReadBytes('\n')
+	if err != nil {
+		return 0
+	}
+	var rec spoolRecord
+	_ = json.Unmarshal(line, &rec)
+	return rec.Ts
+}
+
+// Status 返回spool当前的大小、最早记录时间与各任务待重放的记录数
+func (s *diskSpool) Status() SpoolStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := SpoolStatus{Bytes: s.bytes, MaxBytes: s.maxBytes, Segments: len(s.segments),
+		OldestTs: s.oldestTs(), Pending: map[string]int{}, Dropped: s.dropped, Expired: s.expired}
+	for _, seg := range s.segments {
+		for task, n := range seg.tasks {
+			st.Pending[task] += n
+		}
+	}
+	return st
+}
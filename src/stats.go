@@ -0,0 +1,114 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 检索任务提前结束的原因
+const (
+	TruncatedMaxCount = "maxCount"
+	TruncatedTimeout  = "timeout"
+	TruncatedMaxBytes = "maxBytesScanned"
+	// 实时跟踪任务到达maxSeconds或被结束（包括客户端断开）
+	TruncatedMaxDuration = "maxDuration"
+	TruncatedCancelled   = "cancelled"
+)
+
+// TaskStats 检索任务运行中的统计，由多个扫描协程共享，计数字段使用原子操作更新
+type TaskStats struct {
+	Count     int32
+	FailCount int32
+	LongCount int32
+	// 按列类型转换失败的值的个数
+	ConvertFailCount int32
+	// ES不可用时写入本地spool等待重放的文档数
+	SpooledCount int32
+	BytesScanned int64
+	// 抽样模式下符合条件的日志总数
+	Matched int64
+	reason  atomic.Value
+	uploads sync.WaitGroup
+	// 按ES节点统计的写入失败次数（包括之后重试成功的失败）
+	esFailMu sync.Mutex
+	esFails  map[string]int32
+}
+
+// esFailed 记录一次ES节点写入失败
+func (st *TaskStats) esFailed(host string) {
+	st.esFailMu.Lock()
+	defer st.esFailMu.Unlock()
+	if st.esFails == nil {
+		st.esFails = map[string]int32{}
+	}
+	st.esFails[host]++
+}
+
+// EsFailures 按ES节点返回写入失败次数
+func (st *TaskStats) EsFailures() map[string]int32 {
+	st.esFailMu.Lock()
+	defer st.esFailMu.Unlock()
+	ret := map[string]int32{}
+	for k, v := range st.esFails {
+		ret[k] = v
+	}
+	return ret
+}
+
+// 从任务共享的匹配额度中占用一条，额度已用完时记录结束原因并返回false
+func (st *TaskStats) takeCount(maxCount int) bool {
+	if !st.tryCount(maxCount) {
+		st.truncate(TruncatedMaxCount)
+		return false
+	}
+	return true
+}
+
+// 从匹配额度中占用一条，额度已用完时返回false，不结束任务
+func (st *TaskStats) tryCount(maxCount int) bool {
+	for {
+		c := atomic.LoadInt32(&st.Count)
+		if int(c) >= maxCount {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&st.Count, c, c+1) {
+			return true
+		}
+	}
+}
+
+// 记录任务提前结束的原因，只保留第一个
+func (st *TaskStats) truncate(reason string) {
+	st.reason.CompareAndSwap(nil, reason)
+}
+
+// TruncatedReason 任务提前结束的原因，正常结束时为空
+func (st *TaskStats) TruncatedReason() string {
+	if v := st.reason.Load(); v != nil {
+		return v.(string)
+	}
+	return ""
+}
+
+// 累加已扫描的字节数，并判断任务是否应提前结束
+func (st *TaskStats) scanned(sp *SearchParam, n int) bool {
+	bytes := atomic.AddInt64(&st.BytesScanned, int64(n))
+	return st.stopped(sp, bytes)
+}
+
+// 判断任务是否因超时、超过扫描字节数或已记录结束原因而应提前结束
+func (st *TaskStats) stopped(sp *SearchParam, bytes int64) bool {
+	if st.TruncatedReason() != "" {
+		return true
+	}
+	if sp.MaxBytes > 0 && bytes >= sp.MaxBytes {
+		st.truncate(TruncatedMaxBytes)
+		return true
+	}
+	if !sp.Deadline.IsZero() && time.Now().After(sp.Deadline) {
+		st.truncate(TruncatedTimeout)
+		return true
+	}
+	return false
+}
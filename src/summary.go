@@ -0,0 +1,180 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"searchlog/handle"
+	"sort"
+	"sync"
+)
+
+// TopValue Top-N中的一个值，Count为计数（近似时可能偏大，最多偏大Error）
+type TopValue struct {
+	Value string
+	Count int64
+	Error int64
+}
+
+// ColSummary 一列的汇总结果
+type ColSummary struct {
+	Top      []TopValue `json:",omitempty"`
+	Distinct uint64
+	// Top为精确结果时为true，不同值过多改用Space-Saving近似统计时为false
+	Exact bool
+}
+
+// 按计数排列的最小堆，堆顶为计数最小的值
+type topHeap []*topItem
+
+type topItem struct {
+	TopValue
+	index int
+}
+
+func (h topHeap) Len() int           { return len(h) }
+func (h topHeap) Less(i, j int) bool { return h[i].Count < h[j].Count }
+func (h topHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *topHeap) Push(x interface{}) {
+	item := x.(*topItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+func (h *topHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+// spaceSaving Space-Saving算法统计高频值，最多保留capacity个计数器
+type spaceSaving struct {
+	capacity int
+	items    map[string]*topItem
+	heap     topHeap
+	exact    bool
+}
+
+func newSpaceSaving(capacity int) *spaceSaving {
+	return &spaceSaving{capacity: capacity, items: map[string]*topItem{}, exact: true}
+}
+
+func (ss *spaceSaving) add(v string) {
+	if item, ok := ss.items[v]; ok {
+		item.Count++
+		heap.Fix(&ss.heap, item.index)
+		return
+	}
+	if len(ss.items) < ss.capacity {
+		item := &topItem{TopValue: TopValue{Value: v, Count: 1}}
+		ss.items[v] = item
+		heap.Push(&ss.heap, item)
+		return
+	}
+	// 替换计数最小的值，新值继承其计数作为误差上限
+	ss.exact = false
+	item := ss.heap[0]
+	delete(ss.items, item.Value)
+	item.Value = v
+	item.Error = item.Count
+	item.Count++
+	ss.items[v] = item
+	heap.Fix(&ss.heap, 0)
+}
+
+func (ss *spaceSaving) top(n int) []TopValue {
+	var list []TopValue
+	for _, item := range ss.heap {
+		list = append(list, item.TopValue)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Count != list[j].Count {
+			return list[i].Count > list[j].Count
+		}
+		return list[i].Value < list[j].Value
+	})
+	if len(list) > n {
+		list = list[:n]
+	}
+	return list
+}
+
+// summarizer 汇总模式下统计指定列的Top-N值与近似不同值个数（HyperLogLog）
+type summarizer struct {
+	mu       sync.Mutex
+	cols     []int
+	names    []string
+	topN     int
+	distinct bool
+	tops     []*spaceSaving
+	hlls     []*handle.HyperLogLog
+}
+
+// 根据请求中的summary参数生成汇总器，参数已由check.FreeSearchCheck校验
+func newSummarizer(data map[string]interface{}, logHeader []string, maxTopValues int) *summarizer {
+	sm := &summarizer{topN: 20, distinct: true}
+	if v, ok := data["topN"]; ok {
+		sm.topN = int(v.(float64))
+	}
+	if v, ok := data["distinct"]; ok {
+		sm.distinct = v.(bool)
+	}
+	capacity := sm.topN * 10
+	if capacity < maxTopValues {
+		capacity = maxTopValues
+	}
+	for _, c := range data["columns"].([]interface{}) {
+		col := colIndex(c, logHeader)
+		sm.cols = append(sm.cols, col)
+		sm.names = append(sm.names, colName(col, logHeader))
+		if sm.topN > 0 {
+			sm.tops = append(sm.tops, newSpaceSaving(capacity))
+		}
+		if sm.distinct {
+			sm.hlls = append(sm.hlls, handle.NewHyperLogLog(14))
+		}
+	}
+	return sm
+}
+
+// add 把一条符合条件的日志的指定列计入汇总
+func (sm *summarizer) add(strList []string) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	for i, col := range sm.cols {
+		if col < 0 || col >= len(strList) {
+			continue
+		}
+		if sm.topN > 0 {
+			sm.tops[i].add(strList[col])
+		}
+		if sm.distinct {
+			sm.hlls[i].Add(strList[col])
+		}
+	}
+}
+
+// Result 返回每列的汇总结果，key为列名
+func (sm *summarizer) Result() map[string]ColSummary {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	ret := map[string]ColSummary{}
+	for i, name := range sm.names {
+		if _, ok := ret[name]; ok {
+			name = fmt.Sprintf("%s#%d", name, i+1)
+		}
+		cs := ColSummary{Exact: true}
+		if sm.topN > 0 {
+			cs.Top = sm.tops[i].top(sm.topN)
+			cs.Exact = sm.tops[i].exact
+		}
+		if sm.distinct {
+			cs.Distinct = sm.hlls[i].Count()
+		}
+		ret[name] = cs
+	}
+	return ret
+}
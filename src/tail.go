@@ -0,0 +1,326 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"searchlog/check"
+	"searchlog/handle"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 实时跟踪任务的输出方式：stream通过SSE推送给请求方，es写入ES并在结束后回调RetUrl
+const (
+	TailOutputStream = "stream"
+	TailOutputEs     = "es"
+)
+
+// SSE连接的保活间隔
+const tailKeepalive = 15 * time.Second
+
+// tailTask 一个正在运行的实时跟踪任务，stop后在下一次轮询时结束
+type tailTask struct {
+	TaskId  string
+	LogType string
+	Output  string
+	Files   []string
+	StartTs int64
+	// 最晚结束时间（秒）
+	Until int64
+	st    *TaskStats
+	done  chan struct{}
+	once  sync.Once
+}
+
+func (t *tailTask) stop() {
+	t.once.Do(func() {
+		close(t.done)
+	})
+}
+
+// TailStatus 实时跟踪任务的运行状态
+type TailStatus struct {
+	TaskId  string
+	LogType string
+	Output  string
+	Files   []string
+	StartTs int64
+	Until   int64
+	Count   int32
+}
+
+// tailRegistry 正在运行的实时跟踪任务，最多同时运行max个，与检索任务的调度相互独立
+type tailRegistry struct {
+	mu    sync.Mutex
+	max   int
+	tasks map[string]*tailTask
+}
+
+func newTailRegistry(max int) *tailRegistry {
+	return &tailRegistry{max: max, tasks: map[string]*tailTask{}}
+}
+
+// add 登记任务，相同taskId的任务正在运行或已达到上限时返回false
+func (r *tailRegistry) add(t *tailTask) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.tasks[t.TaskId]; ok || len(r.tasks) >= r.max {
+		return false
+	}
+	r.tasks[t.TaskId] = t
+	return true
+}
+
+func (r *tailRegistry) remove(t *tailTask) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.tasks[t.TaskId] == t {
+		delete(r.tasks, t.TaskId)
+	}
+}
+
+// stop 结束任务，任务不存在时返回false
+func (r *tailRegistry) stop(taskId string) bool {
+	r.mu.Lock()
+	t, ok := r.tasks[taskId]
+	r.mu.Unlock()
+	if ok {
+		t.stop()
+	}
+	return ok
+}
+
+func (r *tailRegistry) status() []TailStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ret := []TailStatus{}
+	for _, t := range r.tasks {
+		ret = append(ret, TailStatus{TaskId: t.TaskId, LogType: t.LogType, Output: t.Output, Files: t.Files,
+			StartTs: t.StartTs, Until: t.Until, Count: atomic.LoadInt32(&t.st.Count)})
+	}
+	return ret
+}
+
+// 跟踪文件列表中新写入的行，把符合selectRegular规则的行交给emit，直到任务被结束、到达最晚结束时间或匹配条数达到maxCount。
+// emit返回false时停止本轮读取（如客户端已断开）
+func runTail(t *tailTask, sp *SearchParam, emit func(rec *LogRecord) bool) {
+	var followers []*handle.Follower
+	for _, file := range t.Files {
+		// 轮转后的压缩文件不会再写入
+		if strings.HasSuffix(file, ".gz") {
+			continue
+		}
+		f, err := handle.NewFollower(file, true, MaxLineBytes)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		followers = append(followers, f)
+	}
+	defer func() {
+		for _, f := range followers {
+			f.Close()
+		}
+	}()
+	deadline := time.NewTimer(time.Until(time.Unix(t.Until, 0)))
+	defer deadline.Stop()
+	ticker := time.NewTicker(TailPollInterval)
+	defer ticker.Stop()
+	for {
+		for _, f := range followers {
+			f := f
+			err := f.Poll(func(line string, offset int64, truncated bool) bool {
+				return tailLine(line, offset, truncated, f, sp, t.st, emit)
+			})
+			if err != nil {
+				log.Println(err)
+			}
+		}
+		if t.st.TruncatedReason() != "" {
+			return
+		}
+		select {
+		case <-t.done:
+			t.st.truncate(TruncatedCancelled)
+			return
+		case <-deadline.C:
+			t.st.truncate(TruncatedMaxDuration)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// 处理跟踪到的一行，返回false时停止读取
+func tailLine(line string, offset int64, truncated bool, f *handle.Follower, sp *SearchParam, st *TaskStats,
+	emit func(rec *LogRecord) bool) bool {
+	if truncated {
+		atomic.AddInt32(&st.LongCount, 1)
+	}
+	atomic.AddInt64(&st.BytesScanned, int64(len(line)+1))
+	strList := strSplit(line, sp.Delimiter, sp.DeAllInOne)
+	if !isTrueLog(strList, sp.SelectRegularList) {
+		return true
+	}
+	// 未配置日期列或日期解析失败时使用读取到该行的时间
+	now := time.Now().UnixNano()
+	ts := now
+	if len(sp.DatePosition) > 0 {
+		anchor := handle.YearAnchor{Start: now, End: now}
+		if logTs, _ := isTimeTrueLog(strList, 0, math.MaxInt64, sp.DatePosition, sp.DateFormat, anchor); logTs > 0 {
+			ts = logTs
+		}
+	}
+	raw := strList
+	strList = sp.Fields.redact(strList)
+	if !st.takeCount(sp.MaxCount) {
+		return false
+	}
+	rec := &LogRecord{StrList: strList, Ts: ts, File: f.Path, FileId: f.Id(), Offset: offset, Truncated: truncated,
+		Fields: sp.Enrich.derive(raw)}
+	return emit(rec)
+}
+
+// 实时跟踪任务结束时的统计
+func tailResult(t *tailTask) RetStruct {
+	st := t.st
+	return RetStruct{
+		TaskId:           t.TaskId,
+		HostName:         check.HostName,
+		DoneTs:           time.Now().Unix(),
+		TotalCount:       int(atomic.LoadInt32(&st.Count)),
+		FailCount:        atomic.LoadInt32(&st.FailCount),
+		LongCount:        atomic.LoadInt32(&st.LongCount),
+		BytesScanned:     atomic.LoadInt64(&st.BytesScanned),
+		TruncatedReason:  st.TruncatedReason(),
+		ConvertFailCount: atomic.LoadInt32(&st.ConvertFailCount),
+		EsFailures:       st.EsFailures(),
+		SpooledCount:     atomic.LoadInt32(&st.SpooledCount),
+	}
+}
+
+// /agent/log/tail，实时跟踪日志文件，把新写入的符合条件的行通过SSE推送给请求方或写入ES
+func tailLog(c *gin.Context) {
+	jsonMap := make(map[string]interface{})
+	err := c.BindJSON(&jsonMap)
+	if err != nil {
+		c.JSON(400, gin.H{"code": 400, "msg": "Json format error!"})
+		return
+	}
+	var filePathList []string
+	msg, ok := check.TailCheck(jsonMap, TailMaxSeconds, &filePathList)
+	if !ok {
+		c.JSON(400, gin.H{"code": 400, "msg": msg})
+		return
+	}
+	sp := newSearchParam(jsonMap)
+	if sp == nil {
+		c.JSON(400, gin.H{"code": 400, "msg": "Error parameter selectRegular,info: value format error"})
+		return
+	}
+	maxSeconds := TailMaxSeconds
+	if v, ok := jsonMap["maxSeconds"]; ok {
+		maxSeconds = int(v.(float64))
+	}
+	output := TailOutputStream
+	if v, ok := jsonMap["output"]; ok {
+		output = fmt.Sprint(v)
+	}
+	now := time.Now()
+	t := &tailTask{
+		TaskId:  sp.TaskId,
+		LogType: fmt.Sprint(jsonMap["logType"]),
+		Output:  output,
+		Files:   filePathList,
+		StartTs: now.Unix(),
+		Until:   now.Add(time.Duration(maxSeconds) * time.Second).Unix(),
+		st:      &TaskStats{},
+		done:    make(chan struct{}),
+	}
+	if !Tails.add(t) {
+		c.JSON(429, gin.H{"code": 429, "msg": "Too many tail tasks, or the taskId is already running"})
+		return
+	}
+
+	if output == TailOutputEs {
+		ensureIndex(sp, t.LogType)
+		c.JSON(200, gin.H{"code": 200, "msg": "Tail task is running", "until": t.Until})
+		go func() {
+			defer Tails.remove(t)
+			runTail(t, sp, func(rec *LogRecord) bool {
+				uploadRecord(rec, sp, t.st)
+				return true
+			})
+			t.st.uploads.Wait()
+			postResult(tailResult(t))
+		}()
+		return
+	}
+
+	defer Tails.remove(t)
+	docs := make(chan map[string]interface{}, 256)
+	go func() {
+		defer close(docs)
+		runTail(t, sp, func(rec *LogRecord) bool {
+			prepareRecord(rec, sp, t.st)
+			select {
+			case docs <- recordDoc(rec, sp, t.st):
+				return true
+			case <-t.done:
+				return false
+			}
+		})
+	}()
+	keepalive := time.NewTicker(tailKeepalive)
+	defer keepalive.Stop()
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case doc, ok := <-docs:
+			if !ok {
+				c.SSEvent("end", tailResult(t))
+				return false
+			}
+			c.SSEvent("match", doc)
+		case <-keepalive.C:
+			c.SSEvent("ping", time.Now().Unix())
+		case <-c.Request.Context().Done():
+			return false
+		}
+		return true
+	})
+	// 客户端断开时结束任务，等待跟踪协程退出
+	t.stop()
+	for range docs {
+	}
+}
+
+// /agent/log/tail/stop，结束实时跟踪任务
+func tailStop(c *gin.Context) {
+	jsonMap := make(map[string]interface{})
+	err := c.BindJSON(&jsonMap)
+	if err != nil {
+		c.JSON(400, gin.H{"code": 400, "msg": "Json format error!"})
+		return
+	}
+	msg, ok := check.TailStopCheck(jsonMap)
+	if !ok {
+		c.JSON(400, gin.H{"code": 400, "msg": msg})
+		return
+	}
+	if !Tails.stop(fmt.Sprint(jsonMap["taskId"])) {
+		c.JSON(404, gin.H{"code": 404, "msg": "Tail task not found"})
+		return
+	}
+	c.JSON(200, gin.H{"code": 200, "msg": "Tail task is stopping"})
+}
+
+// /agent/tail，查看正在运行的实时跟踪任务
+func tailStatus(c *gin.Context) {
+	c.JSON(200, gin.H{"code": 200, "maxTasks": Tails.max, "tasks": Tails.status()})
+}